@@ -0,0 +1,315 @@
+package main
+
+import (
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/antithesishq/antithesis-sdk-go/assert"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/google/uuid"
+)
+
+var (
+	//go:embed db/ops/outbox_list.sql
+	listOutboxEventsQuery string
+
+	//go:embed db/ops/outbox_lag.sql
+	outboxLagQuery string
+
+	//go:embed db/ops/outbox_get_for_update.sql
+	getOutboxEventForUpdateQuery string
+
+	//go:embed db/ops/outbox_requeue.sql
+	requeueOutboxEventQuery string
+
+	//go:embed db/ops/outbox_skip.sql
+	skipOutboxEventQuery string
+)
+
+type (
+	ListOutboxEventsFilter struct {
+		Status      *OutboxStatus
+		EventType   *string
+		AggregateID *int64
+		After       *int64
+		Limit       int
+	}
+
+	ListOutboxEventsResponse struct {
+		Events []OrderEvent `json:"events"`
+
+		// NextAfter is the after parameter of the next page.
+		NextAfter *int64 `json:"next_after,omitempty"`
+	}
+
+	// OutboxLagResponse describes how far behind the relay is. LagSeconds is
+	// the age of the oldest pending event, or 0 when nothing is pending.
+	OutboxLagResponse struct {
+		Pending                int64  `json:"pending"`
+		Failed                 int64  `json:"failed"`
+		OldestPendingCreatedAt *int64 `json:"oldest_pending_created_at,omitempty"`
+		LagSeconds             int64  `json:"lag_seconds"`
+	}
+
+	SkipOutboxEventRequest struct {
+		Reason string `json:"reason,omitempty"`
+	}
+)
+
+// AdminRoutes serves the outbox administration API behind HTTP basic auth
+// with the given credentials, which are separate from any client's.
+func (s *OrderService) AdminRoutes(username, password string) chi.Router {
+	r := chi.NewRouter()
+	r.Use(middleware.BasicAuth("outbox-admin", map[string]string{username: password}))
+	r.Get("/", s.ListOutboxEvents)
+	r.Get("/lag", s.OutboxLag)
+	r.Post("/{eventID}/requeue", s.RequeueOutboxEvent)
+	r.Post("/{eventID}/skip", s.SkipOutboxEvent)
+	return r
+}
+
+// ListOutboxEvents lists outbox events oldest first, pending and failed ones
+// unless a status is given.
+func (s *OrderService) ListOutboxEvents(w http.ResponseWriter, r *http.Request) {
+	assert.Always(s.started, "Service must be started before handling requests", Details{"op": "list_outbox_events"})
+
+	filter, err := parseListOutboxEventsFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rows, err := s.db.QueryContext(r.Context(), listOutboxEventsQuery, filter.args()...)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list outbox events: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	events := []OrderEvent{}
+	for rows.Next() {
+		event, err := scanAdminOutboxEvent(rows)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to scan outbox event: %v", err), http.StatusInternalServerError)
+			return
+		}
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list outbox events: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	response := ListOutboxEventsResponse{Events: events}
+	if len(events) > filter.Limit {
+		response.Events = events[:filter.Limit]
+		next := response.Events[filter.Limit-1].Seq
+		response.NextAfter = &next
+	}
+	writeAdminResponse(w, http.StatusOK, response)
+}
+
+func (s *OrderService) OutboxLag(w http.ResponseWriter, r *http.Request) {
+	assert.Always(s.started, "Service must be started before handling requests", Details{"op": "outbox_lag"})
+
+	var response OutboxLagResponse
+	err := s.db.QueryRowContext(r.Context(), outboxLagQuery).Scan(
+		&response.Pending,
+		&response.Failed,
+		&response.OldestPendingCreatedAt,
+	)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get outbox lag: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if response.OldestPendingCreatedAt != nil {
+		response.LagSeconds = max(time.Now().Unix()-*response.OldestPendingCreatedAt, 0)
+	}
+	writeAdminResponse(w, http.StatusOK, response)
+}
+
+// RequeueOutboxEvent gives a failed event a fresh set of attempts.
+func (s *OrderService) RequeueOutboxEvent(w http.ResponseWriter, r *http.Request) {
+	s.changeOutboxEvent(w, r, "requeue", []OutboxStatus{OutboxStatusFailed}, func(tx *sql.Tx, eventID uuid.UUID) (OrderEvent, error) {
+		return scanAdminOutboxEvent(tx.QueryRowContext(r.Context(), requeueOutboxEventQuery, eventID))
+	})
+}
+
+// SkipOutboxEvent parks a pending or failed event, e.g. a poison event that
+// keeps failing, so the relay never publishes it. The reason is recorded as
+// its last error.
+func (s *OrderService) SkipOutboxEvent(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	var req SkipOutboxEventRequest
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	reason := sql.NullString{String: req.Reason, Valid: req.Reason != ""}
+
+	s.changeOutboxEvent(w, r, "skip", []OutboxStatus{OutboxStatusPending, OutboxStatusFailed}, func(tx *sql.Tx, eventID uuid.UUID) (OrderEvent, error) {
+		return scanAdminOutboxEvent(tx.QueryRowContext(r.Context(), skipOutboxEventQuery, eventID, time.Now().Unix(), reason))
+	})
+}
+
+// changeOutboxEvent locks the event, checks it is in one of the from statuses
+// and applies change. Events the relay is publishing stay locked until its
+// batch commits, so change never races with the relay.
+func (s *OrderService) changeOutboxEvent(w http.ResponseWriter, r *http.Request, op string, from []OutboxStatus, change func(*sql.Tx, uuid.UUID) (OrderEvent, error)) {
+	assert.Always(s.started, "Service must be started before handling requests", Details{"op": op + "_outbox_event"})
+
+	eventID, err := uuid.Parse(chi.URLParam(r, "eventID"))
+	if err != nil {
+		http.Error(w, "Invalid event ID", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := s.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Failed to begin transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	event, err := scanAdminOutboxEvent(tx.QueryRowContext(r.Context(), getOutboxEventForUpdateQuery, eventID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Outbox event not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to get outbox event: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	allowed := false
+	for _, status := range from {
+		allowed = allowed || event.Status == status
+	}
+	if !allowed {
+		http.Error(w, fmt.Sprintf("Cannot %s an outbox event with status %s", op, event.Status), http.StatusConflict)
+		return
+	}
+
+	changed, err := change(tx, eventID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to %s outbox event: %v", op, err), http.StatusInternalServerError)
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, "Failed to commit transaction", http.StatusInternalServerError)
+		return
+	}
+	writeAdminResponse(w, http.StatusOK, changed)
+}
+
+func parseListOutboxEventsFilter(query url.Values) (ListOutboxEventsFilter, error) {
+	filter := ListOutboxEventsFilter{Limit: defaultListLimit}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxListLimit {
+			return filter, fmt.Errorf("limit must be between 1 and %d: got %v", maxListLimit, v)
+		}
+		filter.Limit = limit
+	}
+	if v := query.Get("status"); v != "" {
+		status := OutboxStatus(v)
+		switch status {
+		case OutboxStatusPending, OutboxStatusSucceeded, OutboxStatusFailed, OutboxStatusSkipped:
+		default:
+			return filter, fmt.Errorf("unknown outbox status: %v", v)
+		}
+		filter.Status = &status
+	}
+	if v := query.Get("event_type"); v != "" {
+		filter.EventType = &v
+	}
+	for param, dst := range map[string]**int64{
+		"aggregate_id": &filter.AggregateID,
+		"after":        &filter.After,
+	} {
+		v := query.Get(param)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return filter, fmt.Errorf("%s must be an integer: got %v", param, v)
+		}
+		*dst = &n
+	}
+
+	return filter, nil
+}
+
+// args returns the positional parameters of outbox_list.sql, asking for one
+// extra row to tell whether another page exists.
+func (f ListOutboxEventsFilter) args() []any {
+	var (
+		status      sql.NullString
+		eventType   sql.NullString
+		aggregateID sql.NullInt64
+		after       sql.NullInt64
+	)
+	if f.Status != nil {
+		status = sql.NullString{String: string(*f.Status), Valid: true}
+	}
+	if f.EventType != nil {
+		eventType = sql.NullString{String: *f.EventType, Valid: true}
+	}
+	if f.AggregateID != nil {
+		aggregateID = sql.NullInt64{Int64: *f.AggregateID, Valid: true}
+	}
+	if f.After != nil {
+		after = sql.NullInt64{Int64: *f.After, Valid: true}
+	}
+	return []any{status, eventType, aggregateID, after, f.Limit + 1}
+}
+
+func scanAdminOutboxEvent(row rowScanner) (OrderEvent, error) {
+	var event OrderEvent
+	err := row.Scan(
+		&event.ID,
+		&event.AggregateType,
+		&event.AggregateID,
+		&event.EventType,
+		&event.EventPayload,
+		&event.CreatedAt,
+		&event.ProcessedAt,
+		&event.Status,
+		&event.Attempts,
+		&event.LastError,
+		&event.NextAttemptAt,
+		&event.Seq,
+	)
+	return event, err
+}
+
+func writeAdminResponse(w http.ResponseWriter, status int, response any) {
+	out, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, "Failed to serialize response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(out)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/antithesishq/antithesis-sdk-go/assert"
+)
+
+const (
+	defaultArchiveAfter     = 24 * time.Hour
+	defaultArchiveInterval  = time.Minute
+	defaultArchiveBatchSize = 1000
+)
+
+var (
+	//go:embed db/ops/order_outbox_archive.sql
+	archiveOutboxQuery string
+)
+
+// archiveOutboxEvents moves relayed events older than ArchiveAfter out of
+// order_outboxes every ArchiveInterval until the service is stopped.
+func (s *OrderService) archiveOutboxEvents(ctx context.Context) {
+	assert.Always(s.started, "Service must be started before archiving outbox events", Details{"op": "archive_outbox_events"})
+
+	ticker := time.NewTicker(s.config.ArchiveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if err := s.archiveOldEvents(ctx); err != nil {
+				log.Printf("Error archiving outbox events: %v\n", err)
+			}
+		}
+	}
+}
+
+// archiveOldEvents archives in batches of ArchiveBatchSize, each in its own
+// short transaction, so the relay and writers are never blocked for long.
+func (s *OrderService) archiveOldEvents(ctx context.Context) error {
+	cutoff := time.Now().Add(-s.config.ArchiveAfter).Unix()
+
+	var total int64
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.done:
+			return nil
+		default:
+		}
+
+		res, err := s.db.ExecContext(ctx, archiveOutboxQuery, cutoff, s.config.ArchiveBatchSize, time.Now().Unix())
+		if err != nil {
+			return fmt.Errorf("failed to archive outbox events: %w", err)
+		}
+		archived, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to count archived outbox events: %w", err)
+		}
+		assert.AlwaysOrUnreachable(archived <= int64(s.config.ArchiveBatchSize), "Archive batch size limit must be respected", Details{
+			"archived": archived,
+			"max_size": s.config.ArchiveBatchSize,
+		})
+
+		total += archived
+		if archived < int64(s.config.ArchiveBatchSize) {
+			break
+		}
+	}
+
+	if total > 0 {
+		log.Printf("Archived %d outbox events processed before %d\n", total, cutoff)
+	}
+	return nil
+}
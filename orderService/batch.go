@@ -0,0 +1,164 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/antithesishq/antithesis-sdk-go/assert"
+)
+
+const (
+	BatchModeAtomic     BatchMode = "atomic"
+	BatchModeBestEffort BatchMode = "best_effort"
+
+	maxBatchSize = 500
+)
+
+type (
+	BatchMode string
+
+	CreateOrderBatchRequest struct {
+		Mode   BatchMode         `json:"mode"`
+		Orders []json.RawMessage `json:"orders"`
+	}
+
+	// CreateOrderBatchResult reports the outcome of one order of a batch, in
+	// the same position as in the request. Status is the code the order would
+	// have received from POST /orders; orders that were valid but not created
+	// because another order failed an atomic batch get 424.
+	CreateOrderBatchResult struct {
+		Index  int    `json:"index"`
+		Status int    `json:"status"`
+		Order  *Order `json:"order,omitempty"`
+		Error  string `json:"error,omitempty"`
+	}
+
+	CreateOrderBatchResponse struct {
+		Mode    BatchMode                `json:"mode"`
+		Results []CreateOrderBatchResult `json:"results"`
+	}
+
+	validatedOrder struct {
+		index    int
+		req      CreateOrderRequest
+		currency Currency
+	}
+)
+
+// CreateBatch creates up to maxBatchSize orders in a single transaction with
+// one prepared statement. Every order is validated like in Create. In atomic
+// mode nothing is created unless every order is valid; in best_effort mode
+// the valid orders are created and the invalid ones are reported.
+func (s *OrderService) CreateBatch(w http.ResponseWriter, r *http.Request) {
+	assert.Always(s.started, "Service must be started before handling requests", Details{"op": "create_order_batch"})
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	var batch CreateOrderBatchRequest
+	if err := json.Unmarshal(body, &batch); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if batch.Mode == "" {
+		batch.Mode = BatchModeAtomic
+	}
+	if batch.Mode != BatchModeAtomic && batch.Mode != BatchModeBestEffort {
+		http.Error(w, fmt.Sprintf("Batch mode must be %s or %s: got %v", BatchModeAtomic, BatchModeBestEffort, batch.Mode), http.StatusBadRequest)
+		return
+	}
+	if len(batch.Orders) == 0 || len(batch.Orders) > maxBatchSize {
+		http.Error(w, fmt.Sprintf("Batch must contain between 1 and %d orders: got %d", maxBatchSize, len(batch.Orders)), http.StatusBadRequest)
+		return
+	}
+
+	results := make([]CreateOrderBatchResult, len(batch.Orders))
+	valid := make([]validatedOrder, 0, len(batch.Orders))
+	for i, raw := range batch.Orders {
+		results[i] = CreateOrderBatchResult{Index: i}
+
+		var req CreateOrderRequest
+		if err := json.Unmarshal(raw, &req); err != nil {
+			results[i].Status = http.StatusBadRequest
+			results[i].Error = fmt.Sprintf("Invalid order: %v", err)
+			continue
+		}
+		currency, err := req.Validate()
+		if err != nil {
+			results[i].Status = http.StatusBadRequest
+			results[i].Error = err.Error()
+			continue
+		}
+		valid = append(valid, validatedOrder{index: i, req: req, currency: currency})
+	}
+
+	invalidCount := len(batch.Orders) - len(valid)
+	assert.Sometimes(invalidCount > 0 && len(valid) > 0, "Sometimes a batch mixes valid and invalid orders", Details{"invalid": invalidCount, "valid": len(valid)})
+
+	if batch.Mode == BatchModeAtomic && invalidCount > 0 {
+		for _, v := range valid {
+			results[v.index].Status = http.StatusFailedDependency
+			results[v.index].Error = "Not created because another order in the atomic batch is invalid"
+		}
+		writeBatchResponse(w, http.StatusUnprocessableEntity, CreateOrderBatchResponse{Mode: batch.Mode, Results: results})
+		return
+	}
+
+	if len(valid) > 0 {
+		tx, err := s.db.BeginTx(r.Context(), nil)
+		if err != nil {
+			http.Error(w, "Failed to begin transaction", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		stmt, err := tx.PrepareContext(r.Context(), createOrderQuery)
+		if err != nil {
+			http.Error(w, "Failed to prepare statement", http.StatusInternalServerError)
+			return
+		}
+		defer stmt.Close()
+
+		// Validation already rejected everything the database would, so a
+		// failure here is not the order's fault and aborts the whole batch.
+		for _, v := range valid {
+			order, err := insertOrder(r.Context(), stmt, v.req, v.currency, sql.NullString{}, sql.NullString{})
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Failed to create order %d of the batch: %v", v.index, err), http.StatusInternalServerError)
+				return
+			}
+			results[v.index].Status = http.StatusAccepted
+			results[v.index].Order = &order
+		}
+
+		if err = tx.Commit(); err != nil {
+			http.Error(w, "Failed to commit transaction", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	status := http.StatusAccepted
+	if invalidCount > 0 {
+		status = http.StatusMultiStatus
+	}
+	writeBatchResponse(w, status, CreateOrderBatchResponse{Mode: batch.Mode, Results: results})
+}
+
+func writeBatchResponse(w http.ResponseWriter, status int, response CreateOrderBatchResponse) {
+	out, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, "Failed to serialize response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(out)
+}
@@ -0,0 +1,136 @@
+// Command relay measures how fast the order service's outbox relay drains.
+// It seeds orders through POST /orders:batch and times how long it takes for
+// the matching events to land on the ORDERS stream. Run it against a build
+// before and after a relay change, with the same flags, to compare events/sec:
+//
+//	go run ./bench/relay -orders 20000 -batch 500
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+type (
+	seedOrder struct {
+		Amount      int64  `json:"amount"`
+		Currency    string `json:"currency"`
+		Customer    string `json:"customer"`
+		Description string `json:"description"`
+	}
+
+	seedBatch struct {
+		Mode   string      `json:"mode"`
+		Orders []seedOrder `json:"orders"`
+	}
+)
+
+func main() {
+	orderURLPtr := flag.String("order-url", "http://localhost:8000", "Order service base URL")
+	natsURLPtr := flag.String("nats-url", "nats://localhost:4222", "NATS server URL")
+	ordersPtr := flag.Int("orders", 10000, "Number of orders to seed")
+	batchPtr := flag.Int("batch", 500, "Orders per POST /orders:batch request")
+	timeoutPtr := flag.Duration("timeout", 5*time.Minute, "How long to wait for the outbox to drain")
+	flag.Parse()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeoutPtr)
+	defer cancel()
+
+	nc, err := nats.Connect(*natsURLPtr, nats.UserInfo("guergabo", "password"))
+	if err != nil {
+		log.Fatalf("failed to connect to NATS: %v", err)
+	}
+	defer nc.Close()
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		log.Fatalf("failed to create JetStream context: %v", err)
+	}
+	stream, err := js.Stream(ctx, "ORDERS")
+	if err != nil {
+		log.Fatalf("failed to get ORDERS stream: %v", err)
+	}
+	startSeq, err := lastSequence(ctx, stream)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Seeding and relaying overlap, so the clock starts with the first batch.
+	start := time.Now()
+	for seeded := 0; seeded < *ordersPtr; seeded += *batchPtr {
+		n := min(*batchPtr, *ordersPtr-seeded)
+		if err := seed(ctx, *orderURLPtr, seeded, n); err != nil {
+			log.Fatal(err)
+		}
+	}
+	seededIn := time.Since(start)
+	log.Printf("Seeded %d orders in %v\n", *ordersPtr, seededIn)
+
+	want := startSeq + uint64(*ordersPtr)
+	for {
+		seq, err := lastSequence(ctx, stream)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if seq >= want {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			log.Fatalf("outbox did not drain: %d of %d events published", seq-startSeq, *ordersPtr)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	elapsed := time.Since(start)
+
+	fmt.Printf("orders=%d batch=%d seed=%v drain=%v rate=%.0f events/sec\n",
+		*ordersPtr, *batchPtr, seededIn, elapsed, float64(*ordersPtr)/elapsed.Seconds())
+}
+
+func seed(ctx context.Context, orderURL string, offset, n int) error {
+	batch := seedBatch{Mode: "atomic", Orders: make([]seedOrder, n)}
+	for i := range batch.Orders {
+		batch.Orders[i] = seedOrder{
+			Amount:      100,
+			Currency:    "usd",
+			Customer:    fmt.Sprintf("bench-%d", offset+i),
+			Description: "relay benchmark",
+		}
+	}
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return fmt.Errorf("failed to marshal batch: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, orderURL+"/orders:batch", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to seed orders: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("failed to seed orders: got status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func lastSequence(ctx context.Context, stream jetstream.Stream) (uint64, error) {
+	info, err := stream.Info(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get stream info: %w", err)
+	}
+	return info.State.LastSeq, nil
+}
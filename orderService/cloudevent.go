@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	CloudEventsSpecVersion = "1.0"
+
+	// CloudEventsContentType marks a NATS message whose data is a CloudEvent
+	// in structured mode, i.e. the JSON envelope carries the attributes.
+	CloudEventsContentType = "application/cloudevents+json"
+	ContentTypeHeader      = "Content-Type"
+
+	orderServiceSource = "/order-service"
+)
+
+type (
+	// CloudEvent is a CloudEvents 1.0 envelope in the JSON event format.
+	// Order events carry the outbox row ID as ID, the event type as Type and
+	// the order ID as Subject.
+	CloudEvent struct {
+		SpecVersion     string          `json:"specversion"`
+		ID              string          `json:"id"`
+		Source          string          `json:"source"`
+		Type            string          `json:"type"`
+		Subject         string          `json:"subject,omitempty"`
+		Time            string          `json:"time,omitempty"`
+		DataContentType string          `json:"datacontenttype,omitempty"`
+		DataSchema      string          `json:"dataschema,omitempty"`
+		Data            json.RawMessage `json:"data"`
+	}
+)
+
+func newOrderCloudEvent(event OrderEvent) CloudEvent {
+	return CloudEvent{
+		SpecVersion:     CloudEventsSpecVersion,
+		ID:              event.ID.String(),
+		Source:          orderServiceSource,
+		Type:            event.EventType,
+		Subject:         strconv.FormatInt(event.AggregateID, 10),
+		Time:            time.Unix(event.CreatedAt, 0).UTC().Format(time.RFC3339),
+		DataContentType: "application/json",
+		DataSchema:      fmt.Sprintf("urn:order-service:schemas:%s:v%d", event.EventType, event.SchemaVersion),
+		Data:            event.EventPayload,
+	}
+}
+
+// parseCloudEvent decodes a structured-mode CloudEvent and checks the
+// attributes every event must have.
+func parseCloudEvent(data []byte) (CloudEvent, error) {
+	var event CloudEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return event, fmt.Errorf("invalid cloud event: %w", err)
+	}
+	if event.SpecVersion != CloudEventsSpecVersion {
+		return event, fmt.Errorf("unsupported cloud event spec version: %q", event.SpecVersion)
+	}
+	if event.ID == "" || event.Source == "" || event.Type == "" {
+		return event, fmt.Errorf("cloud event must have an id, source and type")
+	}
+	return event, nil
+}
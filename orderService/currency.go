@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+var (
+	// currencies is the registry of ISO 4217 currencies orders may be placed
+	// in. Codes are lowercase to match Stripe. Limits are in minor units and
+	// follow Stripe's minimum and maximum charge amounts.
+	currencies = map[string]Currency{
+		"usd": {Code: "usd", Exponent: 2, Enabled: true, MinAmount: 50, MaxAmount: 99999999},
+		"eur": {Code: "eur", Exponent: 2, Enabled: true, MinAmount: 50, MaxAmount: 99999999},
+		"gbp": {Code: "gbp", Exponent: 2, Enabled: true, MinAmount: 30, MaxAmount: 99999999},
+		"cad": {Code: "cad", Exponent: 2, Enabled: true, MinAmount: 50, MaxAmount: 99999999},
+		"aud": {Code: "aud", Exponent: 2, Enabled: true, MinAmount: 50, MaxAmount: 99999999},
+		"chf": {Code: "chf", Exponent: 2, Enabled: true, MinAmount: 50, MaxAmount: 99999999},
+		"jpy": {Code: "jpy", Exponent: 0, Enabled: true, MinAmount: 50, MaxAmount: 99999999},
+		// Three-decimal currencies need Stripe-specific rounding we do not support yet.
+		"bhd": {Code: "bhd", Exponent: 3, Enabled: false, MinAmount: 500, MaxAmount: 99999990},
+		"kwd": {Code: "kwd", Exponent: 3, Enabled: false, MinAmount: 500, MaxAmount: 99999990},
+	}
+)
+
+type (
+	Currency struct {
+		Code      string
+		Exponent  int // Number of minor-unit digits, e.g. 2 for usd and 0 for jpy.
+		Enabled   bool
+		MinAmount MinorUnits
+		MaxAmount MinorUnits
+	}
+)
+
+// lookupCurrency resolves a currency code from a request against the registry.
+func lookupCurrency(code string) (Currency, error) {
+	currency, ok := currencies[strings.ToLower(code)]
+	if !ok {
+		return Currency{}, fmt.Errorf("Order currency is not a supported ISO 4217 code: got %v", code)
+	}
+	if !currency.Enabled {
+		return Currency{}, fmt.Errorf("Order currency is not enabled: got %v", code)
+	}
+	return currency, nil
+}
+
+func (c Currency) ValidateAmount(amount MinorUnits) error {
+	if amount < c.MinAmount || amount > c.MaxAmount {
+		return fmt.Errorf("Order amount must be between %d and %d %s minor units: got %d", c.MinAmount, c.MaxAmount, c.Code, amount)
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+SELECT
+    idempotency_key,
+    request_hash,
+    order_id,
+    status_code,
+    created_at
+FROM order_idempotency_keys
+WHERE idempotency_key = $1;
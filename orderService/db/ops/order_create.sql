@@ -4,6 +4,7 @@ WITH new_order AS (
         currency, 
         customer_id, 
         description,
+        customer_metadata,
         created_at
     )
     VALUES (
@@ -11,34 +12,93 @@ WITH new_order AS (
         $2, 
         $3, 
         $4, 
+        $9, 
         $5
     )
     RETURNING *
 ),
 order_event AS (
     INSERT INTO order_outboxes (
+        id,
         aggregate_type, 
         aggregate_id, 
         event_type,
         event_payload,
+        schema_version,
         created_at
     )
     SELECT 
-        'orders', -- TODO: align with NATs.
+        $12::UUID,
+        'Order',
         id,
         'ORDER_CREATED',
         jsonb_build_object( 
+            'order_id', id,
+            'event_id', $12::UUID,
+            'created_at', created_at,
             'amount', amount,
             'currency', currency,
+            'currency_exponent', $10::INT,
             'customer', customer_id,
-            'description', description
+            'description', description,
+            'items', $11::JSONB
         ),
+        2, -- schema_version
         created_at
     FROM new_order
     RETURNING *
+),
+new_items AS (
+    INSERT INTO order_items (
+        order_id,
+        sku,
+        quantity,
+        unit_price
+    )
+    SELECT
+        new_order.id,
+        item.sku,
+        item.quantity,
+        item.unit_price
+    FROM new_order, jsonb_to_recordset($11::JSONB) AS item(sku TEXT, quantity INT, unit_price BIGINT)
+),
+idempotency_key AS (
+    INSERT INTO order_idempotency_keys (
+        idempotency_key,
+        request_hash,
+        order_id,
+        status_code,
+        created_at
+    )
+    SELECT
+        $6::TEXT,
+        $7::TEXT,
+        id,
+        $8::INT,
+        created_at
+    FROM new_order
+    WHERE $6::TEXT IS NOT NULL
 )
 SELECT
-    o.*,
-    e.*
+    o.id,
+    o.amount,
+    o.currency,
+    o.customer_id,
+    o.description,
+    o.created_at,
+    o.updated_at,
+    o.status,
+    o.customer_metadata,
+    o.version,
+    o.charge_id,
+    o.refunded_amount,
+    e.id,
+    e.aggregate_type,
+    e.aggregate_id,
+    e.event_type,
+    e.event_payload,
+    e.created_at,
+    e.processed_at,
+    e.status
 FROM new_order o 
 JOIN order_event e ON e.aggregate_id = o.id; 
@@ -0,0 +1,19 @@
+UPDATE order_outboxes 
+SET 
+    attempts = attempts + 1,
+    last_error = $1,
+    processed_at = $2,
+    status = 'failed'
+WHERE id = $3
+RETURNING
+    id,
+    aggregate_type,
+    aggregate_id,
+    event_type,
+    event_payload,
+    created_at,
+    processed_at,
+    status,
+    attempts,
+    last_error,
+    next_attempt_at
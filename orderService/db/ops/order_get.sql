@@ -1,8 +1,15 @@
 SELECT
     id, 
     amount, 
+    currency,
+    customer_id,
+    description,
     created_at, 
     updated_at, 
-    status
+    status,
+    customer_metadata,
+    version,
+    charge_id,
+    refunded_amount
 FROM orders
 WHERE id = $1;
@@ -0,0 +1,16 @@
+SELECT
+    id, 
+    amount, 
+    currency,
+    customer_id,
+    description,
+    created_at, 
+    updated_at, 
+    status,
+    customer_metadata,
+    version,
+    charge_id,
+    refunded_amount
+FROM orders
+WHERE id = $1
+FOR UPDATE;
@@ -0,0 +1,7 @@
+SELECT
+    sku,
+    quantity,
+    unit_price
+FROM order_items
+WHERE order_id = $1
+ORDER BY id ASC;
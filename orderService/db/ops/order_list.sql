@@ -6,5 +6,16 @@ SELECT
     description,
     created_at,
     updated_at,
-    status
+    status,
+    customer_metadata,
+    version,
+    charge_id,
+    refunded_amount
 FROM orders
+WHERE ($1::ORDER_STATUS IS NULL OR status = $1::ORDER_STATUS)
+    AND ($2::TEXT IS NULL OR customer_id = $2::TEXT)
+    AND ($3::BIGINT IS NULL OR created_at > $3::BIGINT)
+    AND ($4::BIGINT IS NULL OR created_at < $4::BIGINT)
+    AND ($5::BIGINT IS NULL OR (created_at, id) > ($5::BIGINT, $6::BIGINT))
+ORDER BY created_at ASC, id ASC
+LIMIT $7
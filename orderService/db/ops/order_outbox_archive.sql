@@ -0,0 +1,15 @@
+WITH archived AS (
+    DELETE FROM order_outboxes
+    WHERE id IN (
+        SELECT id
+        FROM order_outboxes
+        WHERE status IN ('succeeded', 'skipped') AND processed_at < $1
+        ORDER BY processed_at ASC
+        LIMIT $2
+        FOR UPDATE SKIP LOCKED
+    )
+    RETURNING *
+)
+INSERT INTO order_outbox_archive
+SELECT *, $3::BIGINT
+FROM archived
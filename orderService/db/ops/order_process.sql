@@ -1,14 +1,22 @@
 SELECT
-    id, 
-    aggregate_type,
-    aggregate_id,
-    event_type,
-    event_payload,
-    created_at,
-    processed_at,
-    status
-FROM order_outboxes 
-WHERE processed_at IS NULL AND status = 'pending'
-ORDER BY created_at ASC
+    e.id, 
+    e.aggregate_type,
+    e.aggregate_id,
+    e.event_type,
+    e.event_payload,
+    e.created_at,
+    e.processed_at,
+    e.status,
+    e.attempts,
+    e.last_error,
+    e.next_attempt_at,
+    e.schema_version,
+    o.status,
+    r.subject
+FROM order_outboxes e
+JOIN orders o ON o.id = e.aggregate_id
+JOIN outbox_routes r ON r.aggregate_type = e.aggregate_type AND r.event_type = e.event_type
+WHERE e.processed_at IS NULL AND e.status = 'pending' AND e.next_attempt_at <= $2
+ORDER BY e.created_at ASC
 LIMIT $1
-FOR UPDATE SKIP LOCKED
+FOR UPDATE OF e SKIP LOCKED
@@ -0,0 +1,30 @@
+-- Like order_process.sql, but only selects the oldest pending event of each
+-- order, by seq. Later events of an order wait until it is relayed, skipped or
+-- failed, even while it is backing off or another replica holds it locked.
+SELECT
+    e.id, 
+    e.aggregate_type,
+    e.aggregate_id,
+    e.event_type,
+    e.event_payload,
+    e.created_at,
+    e.processed_at,
+    e.status,
+    e.attempts,
+    e.last_error,
+    e.next_attempt_at,
+    e.schema_version,
+    o.status,
+    r.subject
+FROM order_outboxes e
+JOIN orders o ON o.id = e.aggregate_id
+JOIN outbox_routes r ON r.aggregate_type = e.aggregate_type AND r.event_type = e.event_type
+WHERE e.processed_at IS NULL AND e.status = 'pending' AND e.next_attempt_at <= $2
+AND NOT EXISTS (
+    SELECT 1
+    FROM order_outboxes p
+    WHERE p.aggregate_id = e.aggregate_id AND p.status = 'pending' AND p.seq < e.seq
+)
+ORDER BY e.seq ASC
+LIMIT $1
+FOR UPDATE OF e SKIP LOCKED
@@ -2,5 +2,16 @@ UPDATE order_outboxes
 SET 
     processed_at = $1,
     status = 'succeeded'
-WHERE id = $2
-RETURNING *
+WHERE id = ANY($2::UUID[])
+RETURNING
+    id,
+    aggregate_type,
+    aggregate_id,
+    event_type,
+    event_payload,
+    created_at,
+    processed_at,
+    status,
+    attempts,
+    last_error,
+    next_attempt_at
@@ -0,0 +1,64 @@
+WITH new_refund AS (
+    INSERT INTO order_refunds (
+        order_id,
+        amount,
+        currency,
+        reason,
+        created_at
+    )
+    VALUES (
+        $1,
+        $2,
+        $3,
+        $4,
+        $5
+    )
+    RETURNING *
+),
+refund_event AS (
+    INSERT INTO order_outboxes (
+        aggregate_type, 
+        aggregate_id, 
+        event_type,
+        event_payload,
+        schema_version,
+        created_at
+    )
+    SELECT 
+        'Order',
+        order_id,
+        'ORDER_REFUND_REQUESTED',
+        jsonb_build_object( 
+            'refund_id', id,
+            'order_id', order_id,
+            'charge_id', $6::TEXT,
+            'amount', amount,
+            'currency', currency,
+            'reason', reason
+        ),
+        1, -- schema_version
+        created_at
+    FROM new_refund
+    RETURNING *
+)
+SELECT
+    r.id,
+    r.order_id,
+    r.amount,
+    r.currency,
+    r.reason,
+    r.status,
+    r.stripe_refund_id,
+    r.failure_reason,
+    r.created_at,
+    r.updated_at,
+    e.id,
+    e.aggregate_type,
+    e.aggregate_id,
+    e.event_type,
+    e.event_payload,
+    e.created_at,
+    e.processed_at,
+    e.status
+FROM new_refund r 
+JOIN refund_event e ON e.aggregate_id = r.order_id; 
@@ -0,0 +1,14 @@
+SELECT
+    id,
+    order_id,
+    amount,
+    currency,
+    reason,
+    status,
+    stripe_refund_id,
+    failure_reason,
+    created_at,
+    updated_at
+FROM order_refunds
+WHERE id = $1
+FOR UPDATE;
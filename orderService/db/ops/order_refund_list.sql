@@ -0,0 +1,14 @@
+SELECT
+    id,
+    order_id,
+    amount,
+    currency,
+    reason,
+    status,
+    stripe_refund_id,
+    failure_reason,
+    created_at,
+    updated_at
+FROM order_refunds
+WHERE order_id = $1
+ORDER BY created_at ASC, id ASC;
@@ -0,0 +1,3 @@
+SELECT COALESCE(SUM(amount), 0)
+FROM order_refunds
+WHERE order_id = $1 AND status = 'pending';
@@ -0,0 +1,18 @@
+UPDATE order_refunds
+SET
+    status = $2,
+    stripe_refund_id = $3,
+    failure_reason = $4,
+    updated_at = $5
+WHERE id = $1
+RETURNING
+    id,
+    order_id,
+    amount,
+    currency,
+    reason,
+    status,
+    stripe_refund_id,
+    failure_reason,
+    created_at,
+    updated_at
@@ -0,0 +1,20 @@
+UPDATE orders
+SET
+    refunded_amount = refunded_amount + $2,
+    status = $3,
+    updated_at = $4,
+    version = version + 1
+WHERE id = $1
+RETURNING
+    id,
+    amount,
+    currency,
+    customer_id,
+    description,
+    created_at,
+    updated_at,
+    status,
+    customer_metadata,
+    version,
+    charge_id,
+    refunded_amount
@@ -0,0 +1,17 @@
+UPDATE order_outboxes 
+SET 
+    processed_at = $1,
+    status = 'skipped'
+WHERE id = ANY($2::UUID[])
+RETURNING
+    id,
+    aggregate_type,
+    aggregate_id,
+    event_type,
+    event_payload,
+    created_at,
+    processed_at,
+    status,
+    attempts,
+    last_error,
+    next_attempt_at
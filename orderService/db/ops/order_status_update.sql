@@ -1 +1,20 @@
--- TODO: need to consume to update order status.
+UPDATE orders
+SET
+    status = $2,
+    updated_at = $3,
+    version = version + 1,
+    charge_id = COALESCE($4, charge_id)
+WHERE id = $1
+RETURNING
+    id,
+    amount,
+    currency,
+    customer_id,
+    description,
+    created_at,
+    updated_at,
+    status,
+    customer_metadata,
+    version,
+    charge_id,
+    refunded_amount
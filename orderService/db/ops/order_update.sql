@@ -0,0 +1,57 @@
+WITH updated_order AS (
+    UPDATE orders
+    SET
+        description = COALESCE($2, description),
+        customer_metadata = COALESCE($3, customer_metadata),
+        updated_at = $4,
+        version = version + 1
+    WHERE id = $1 AND version = $5
+    RETURNING *
+),
+order_event AS (
+    INSERT INTO order_outboxes (
+        aggregate_type, 
+        aggregate_id, 
+        event_type,
+        event_payload,
+        schema_version,
+        created_at
+    )
+    SELECT 
+        'Order',
+        id,
+        'ORDER_UPDATED',
+        jsonb_build_object( 
+            'customer', customer_id,
+            'customer_metadata', customer_metadata,
+            'description', description,
+            'version', version
+        ),
+        1, -- schema_version
+        updated_at
+    FROM updated_order
+    RETURNING *
+)
+SELECT
+    o.id,
+    o.amount,
+    o.currency,
+    o.customer_id,
+    o.description,
+    o.created_at,
+    o.updated_at,
+    o.status,
+    o.customer_metadata,
+    o.version,
+    o.charge_id,
+    o.refunded_amount,
+    e.id,
+    e.aggregate_type,
+    e.aggregate_id,
+    e.event_type,
+    e.event_payload,
+    e.created_at,
+    e.processed_at,
+    e.status
+FROM updated_order o 
+JOIN order_event e ON e.aggregate_id = o.id; 
@@ -0,0 +1,16 @@
+SELECT
+    id,
+    aggregate_type,
+    aggregate_id,
+    event_type,
+    event_payload,
+    created_at,
+    processed_at,
+    status,
+    attempts,
+    last_error,
+    next_attempt_at,
+    seq
+FROM order_outboxes
+WHERE id = $1
+FOR UPDATE
@@ -0,0 +1,5 @@
+SELECT
+    COUNT(*) FILTER (WHERE status = 'pending'),
+    COUNT(*) FILTER (WHERE status = 'failed'),
+    MIN(created_at) FILTER (WHERE status = 'pending')
+FROM order_outboxes
@@ -0,0 +1,20 @@
+SELECT
+    id,
+    aggregate_type,
+    aggregate_id,
+    event_type,
+    event_payload,
+    created_at,
+    processed_at,
+    status,
+    attempts,
+    last_error,
+    next_attempt_at,
+    seq
+FROM order_outboxes
+WHERE ($1::OUTBOX_STATUS IS NULL AND status IN ('pending', 'failed') OR status = $1)
+AND ($2::TEXT IS NULL OR event_type = $2)
+AND ($3::BIGINT IS NULL OR aggregate_id = $3)
+AND ($4::BIGINT IS NULL OR seq > $4)
+ORDER BY seq ASC
+LIMIT $5
@@ -0,0 +1,20 @@
+UPDATE order_outboxes
+SET
+    status = 'pending',
+    processed_at = NULL,
+    attempts = 0,
+    next_attempt_at = 0
+WHERE id = $1
+RETURNING
+    id,
+    aggregate_type,
+    aggregate_id,
+    event_type,
+    event_payload,
+    created_at,
+    processed_at,
+    status,
+    attempts,
+    last_error,
+    next_attempt_at,
+    seq
@@ -0,0 +1,19 @@
+UPDATE order_outboxes
+SET
+    status = 'skipped',
+    processed_at = $2,
+    last_error = COALESCE($3, last_error)
+WHERE id = $1
+RETURNING
+    id,
+    aggregate_type,
+    aggregate_id,
+    event_type,
+    event_payload,
+    created_at,
+    processed_at,
+    status,
+    attempts,
+    last_error,
+    next_attempt_at,
+    seq
@@ -1,10 +1,24 @@
 DROP TYPE IF EXISTS ORDER_STATUS CASCADE;
 DROP TYPE IF EXISTS OUTBOX_STATUS CASCADE;
+DROP TYPE IF EXISTS REFUND_STATUS CASCADE;
 
 DROP TABLE IF EXISTS order_outboxes;
+DROP TABLE IF EXISTS order_outbox_archive;
+DROP TABLE IF EXISTS outbox_routes;
+DROP TABLE IF EXISTS order_idempotency_keys;
+DROP TABLE IF EXISTS order_items;
+DROP TABLE IF EXISTS order_refunds;
 DROP TABLE IF EXISTS orders; --remove for antithesis
 
 CREATE TYPE ORDER_STATUS AS ENUM (
+    'pending', 
+    'succeeded', 
+    'failed',
+    'cancelled',
+    'refunded'
+); 
+
+CREATE TYPE REFUND_STATUS AS ENUM (
     'pending', 
     'succeeded', 
     'failed'
@@ -13,31 +27,130 @@ CREATE TYPE ORDER_STATUS AS ENUM (
 CREATE TYPE OUTBOX_STATUS AS ENUM (
     'pending', 
     'succeeded', 
-    'failed'
+    'failed',
+    'skipped'
 ); 
 
 CREATE TABLE IF NOT EXISTS orders (
     id          BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
-    amount      NUMERIC(10, 2) NOT NULL CONSTRAINT amount_must_be_positive CHECK (amount > 0),
+    amount      BIGINT NOT NULL CONSTRAINT amount_must_be_positive CHECK (amount > 0), -- minor units
     currency    TEXT NOT NULL DEFAULT 'usd',
     customer_id TEXT NOT NULL, 
     description TEXT NOT NULL, 
     created_at  BIGINT NOT NULL,
     updated_at  BIGINT,
-    status      ORDER_STATUS NOT NULL DEFAULT 'pending'
+    status      ORDER_STATUS NOT NULL DEFAULT 'pending',
+    customer_metadata JSONB NOT NULL DEFAULT '{}',
+    version     BIGINT NOT NULL DEFAULT 1,
+    charge_id   TEXT,
+    refunded_amount BIGINT NOT NULL DEFAULT 0 -- minor units
+);
+
+-- Keyset pagination over (created_at, id), optionally narrowed by status or customer.
+CREATE INDEX IF NOT EXISTS orders_created_at_id_idx ON orders (created_at, id);
+CREATE INDEX IF NOT EXISTS orders_status_created_at_id_idx ON orders (status, created_at, id);
+CREATE INDEX IF NOT EXISTS orders_customer_id_created_at_id_idx ON orders (customer_id, created_at, id);
+
+CREATE TABLE IF NOT EXISTS order_items (
+    id         BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    order_id   BIGINT NOT NULL,
+    sku        TEXT NOT NULL,
+    quantity   INT NOT NULL CONSTRAINT quantity_must_be_positive CHECK (quantity > 0),
+    unit_price BIGINT NOT NULL CONSTRAINT unit_price_must_be_positive CHECK (unit_price > 0), -- minor units
+
+    CONSTRAINT fk_order FOREIGN KEY (order_id) REFERENCES orders(id)
 );
 
+CREATE INDEX IF NOT EXISTS order_items_order_id_idx ON order_items (order_id);
+
+CREATE TABLE IF NOT EXISTS order_refunds (
+    id               UUID DEFAULT gen_random_uuid() PRIMARY KEY,
+    order_id         BIGINT NOT NULL,
+    amount           BIGINT NOT NULL CONSTRAINT refund_amount_must_be_positive CHECK (amount > 0), -- minor units
+    currency         TEXT NOT NULL,
+    reason           TEXT NOT NULL DEFAULT '',
+    status           REFUND_STATUS NOT NULL DEFAULT 'pending',
+    stripe_refund_id TEXT,
+    failure_reason   TEXT,
+    created_at       BIGINT NOT NULL,
+    updated_at       BIGINT,
+
+    CONSTRAINT fk_order FOREIGN KEY (order_id) REFERENCES orders(id)
+);
+
+CREATE INDEX IF NOT EXISTS order_refunds_order_id_idx ON order_refunds (order_id);
+
+-- Every (aggregate_type, event_type) an outbox row may carry, and the NATS
+-- subject the relay publishes it to. Rows for unknown combinations are
+-- rejected by the foreign key on order_outboxes.
+CREATE TABLE IF NOT EXISTS outbox_routes (
+    aggregate_type TEXT NOT NULL,
+    event_type     TEXT NOT NULL,
+    subject        TEXT NOT NULL,
+
+    PRIMARY KEY (aggregate_type, event_type)
+);
+
+INSERT INTO outbox_routes (aggregate_type, event_type, subject) VALUES
+    ('Order', 'ORDER_CREATED', 'ORDERS.created'),
+    ('Order', 'ORDER_CANCELLED', 'ORDERS.cancelled'),
+    ('Order', 'ORDER_UPDATED', 'ORDERS.updated'),
+    ('Order', 'ORDER_REFUND_REQUESTED', 'ORDERS.refund_requested');
+
 CREATE TABLE IF NOT EXISTS order_outboxes (
     id             UUID DEFAULT gen_random_uuid() PRIMARY KEY, 
+    seq            BIGINT GENERATED ALWAYS AS IDENTITY, -- insertion order, as created_at only has second precision
     aggregate_type TEXT NOT NULL, 
     aggregate_id   BIGINT NOT NULL, 
     event_type     TEXT NOT NULL,  
     event_payload  JSONB NOT NULL,
+    schema_version INT NOT NULL, -- version of the event_type schema event_payload conforms to
     created_at     BIGINT NOT NULL,
     processed_at   BIGINT,
     status         OUTBOX_STATUS NOT NULL DEFAULT 'pending',
+    attempts        INT NOT NULL DEFAULT 0,
+    last_error      TEXT,
+    next_attempt_at BIGINT NOT NULL DEFAULT 0, -- pending rows are not relayed before this time
 
-    CONSTRAINT fk_order FOREIGN KEY (aggregate_id) REFERENCES orders(id)
+    CONSTRAINT fk_order FOREIGN KEY (aggregate_id) REFERENCES orders(id),
+    CONSTRAINT fk_route FOREIGN KEY (aggregate_type, event_type) REFERENCES outbox_routes(aggregate_type, event_type)
 ); 
 
--- TODO: add indexes.
+-- The relay only ever scans pending rows, and the archival job processed ones.
+CREATE INDEX IF NOT EXISTS order_outboxes_pending_idx ON order_outboxes (created_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS order_outboxes_pending_aggregate_idx ON order_outboxes (aggregate_id, seq) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS order_outboxes_processed_at_idx ON order_outboxes (processed_at) WHERE status IN ('succeeded', 'skipped');
+
+-- Relayed rows are moved here once they are old enough, keeping order_outboxes
+-- small. Archived rows do not reference orders so they can outlive them.
+CREATE TABLE IF NOT EXISTS order_outbox_archive (
+    LIKE order_outboxes INCLUDING DEFAULTS,
+    archived_at BIGINT NOT NULL,
+
+    PRIMARY KEY (id)
+);
+
+-- Wake the outbox relay when events are written. Notifications are delivered
+-- on commit and collapsed per transaction, so one statement-level NOTIFY per
+-- insert is enough.
+CREATE OR REPLACE FUNCTION notify_order_outbox() RETURNS TRIGGER AS $$
+BEGIN
+    PERFORM pg_notify('order_outbox', '');
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER order_outboxes_notify
+AFTER INSERT ON order_outboxes
+FOR EACH STATEMENT EXECUTE FUNCTION notify_order_outbox();
+
+CREATE TABLE IF NOT EXISTS order_idempotency_keys (
+    idempotency_key TEXT PRIMARY KEY,
+    request_hash    TEXT NOT NULL,
+    order_id        BIGINT NOT NULL,
+    status_code     INT NOT NULL,
+    created_at      BIGINT NOT NULL,
+
+    CONSTRAINT fk_order FOREIGN KEY (order_id) REFERENCES orders(id)
+);
+
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	ETagHeader    = "ETag"
+	IfMatchHeader = "If-Match"
+)
+
+// orderETag derives the entity tag of an order from its version column.
+func orderETag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+// parseIfMatch extracts the order version from an If-Match header produced
+// by orderETag. Weak tags are refused since updates need a strong comparison.
+func parseIfMatch(header string) (int64, error) {
+	tag := strings.TrimSpace(header)
+	if strings.HasPrefix(tag, "W/") {
+		return 0, fmt.Errorf("weak entity tags cannot be used for updates")
+	}
+	unquoted, err := strconv.Unquote(tag)
+	if err != nil {
+		return 0, fmt.Errorf("malformed entity tag: %v", header)
+	}
+	version, err := strconv.ParseInt(unquoted, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("malformed entity tag: %v", header)
+	}
+	return version, nil
+}
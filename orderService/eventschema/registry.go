@@ -0,0 +1,111 @@
+// Package eventschema is the registry of the JSON Schemas outbox event
+// payloads must conform to. There is one schema per event type and version,
+// embedded from schemas/<EVENT_TYPE>.v<version>.json.
+package eventschema
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"strconv"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+var (
+	//go:embed schemas/*.json
+	files embed.FS
+
+	fileName = regexp.MustCompile(`^([A-Z_]+)\.v([0-9]+)\.json$`)
+
+	ErrUnknownSchema = errors.New("unknown event schema")
+)
+
+type (
+	Key struct {
+		EventType string
+		Version   int
+	}
+
+	Registry struct {
+		schemas map[Key]*jsonschema.Schema
+	}
+
+	// ValidationError reports a payload that does not conform to its schema.
+	ValidationError struct {
+		Key Key
+		Err error
+	}
+)
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s v%d payload does not conform to its schema: %v", e.Key.EventType, e.Key.Version, e.Err)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// Load compiles every embedded schema.
+func Load() (*Registry, error) {
+	entries, err := fs.ReadDir(files, "schemas")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schemas: %w", err)
+	}
+
+	compiler := jsonschema.NewCompiler()
+	compiler.Draft = jsonschema.Draft2020
+	compiler.AssertFormat = true
+
+	registry := &Registry{schemas: make(map[Key]*jsonschema.Schema)}
+	for _, entry := range entries {
+		match := fileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("schema file name must be <EVENT_TYPE>.v<version>.json: got %s", entry.Name())
+		}
+		version, _ := strconv.Atoi(match[2])
+		key := Key{EventType: match[1], Version: version}
+
+		raw, err := files.ReadFile(path.Join("schemas", entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read schema %s: %w", entry.Name(), err)
+		}
+		url := "mem://schemas/" + entry.Name()
+		if err := compiler.AddResource(url, bytes.NewReader(raw)); err != nil {
+			return nil, fmt.Errorf("failed to add schema %s: %w", entry.Name(), err)
+		}
+		schema, err := compiler.Compile(url)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile schema %s: %w", entry.Name(), err)
+		}
+		registry.schemas[key] = schema
+	}
+	return registry, nil
+}
+
+// Validate checks payload against the schema of eventType at version. It
+// returns an error wrapping ErrUnknownSchema when there is no such schema and
+// a *ValidationError when the payload does not conform.
+func (r *Registry) Validate(eventType string, version int, payload []byte) error {
+	key := Key{EventType: eventType, Version: version}
+	schema, ok := r.schemas[key]
+	if !ok {
+		return fmt.Errorf("%w: %s v%d", ErrUnknownSchema, eventType, version)
+	}
+
+	var doc any
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return &ValidationError{Key: key, Err: err}
+	}
+	if err := schema.Validate(doc); err != nil {
+		return &ValidationError{Key: key, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/lib/pq"
+)
+
+const (
+	IdempotencyKeyHeader     = "Idempotency-Key"
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+	uniqueViolationErrorCode = "23505"
+	idempotencyKeyConstraint = "order_idempotency_keys_pkey"
+)
+
+var (
+	//go:embed db/ops/idempotency_key_get.sql
+	getIdempotencyKeyQuery string
+
+	errIdempotencyKeyConflict = errors.New("idempotency key was already used with a different request body")
+)
+
+type (
+	IdempotencyKey struct {
+		Key         string `json:"idempotency_key" db:"idempotency_key"`
+		RequestHash string `json:"request_hash" db:"request_hash"`
+		OrderID     int64  `json:"order_id" db:"order_id"`
+		StatusCode  int    `json:"status_code" db:"status_code"`
+		CreatedAt   int64  `json:"created_at" db:"created_at"`
+	}
+)
+
+// hashCreateOrderRequest fingerprints the decoded request so that retries
+// with semantically identical bodies are treated as the same request.
+func hashCreateOrderRequest(req CreateOrderRequest) (string, error) {
+	canonical, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func getIdempotencyKey(ctx context.Context, tx *sql.Tx, key string) (*IdempotencyKey, error) {
+	var record IdempotencyKey
+	err := tx.QueryRowContext(ctx, getIdempotencyKeyQuery, key).Scan(
+		&record.Key,
+		&record.RequestHash,
+		&record.OrderID,
+		&record.StatusCode,
+		&record.CreatedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &record, nil
+}
+
+// replayCreate answers a retried create with the order and status code of the
+// request that first used the idempotency key.
+func (s *OrderService) replayCreate(w http.ResponseWriter, r *http.Request, tx *sql.Tx, record *IdempotencyKey, requestHash string) {
+	if record.RequestHash != requestHash {
+		http.Error(w, errIdempotencyKeyConflict.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	order, err := getOrder(r.Context(), tx, record.OrderID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get order for idempotency key: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, "Failed to commit transaction", http.StatusInternalServerError)
+		return
+	}
+
+	out, err := json.Marshal(order)
+	if err != nil {
+		http.Error(w, "Failed to serialize response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(ETagHeader, orderETag(order.Version))
+	w.Header().Set(IdempotentReplayedHeader, "true")
+	w.WriteHeader(record.StatusCode)
+	w.Write(out)
+}
+
+// replayConcurrentCreate is used when a concurrent request with the same
+// idempotency key committed first and our insert lost the race.
+func (s *OrderService) replayConcurrentCreate(w http.ResponseWriter, r *http.Request, key string, requestHash string) {
+	tx, err := s.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Failed to begin transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	record, err := getIdempotencyKey(r.Context(), tx, key)
+	if err != nil || record == nil {
+		http.Error(w, "Failed to get idempotency key", http.StatusInternalServerError)
+		return
+	}
+	s.replayCreate(w, r, tx, record, requestHash)
+}
+
+func isIdempotencyKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	return pqErr.Code == uniqueViolationErrorCode && pqErr.Constraint == idempotencyKeyConstraint
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"fmt"
+	"math"
+)
+
+const (
+	maxOrderItems = 100
+)
+
+var (
+	//go:embed db/ops/order_items_get.sql
+	getOrderItemsQuery string
+)
+
+type (
+	OrderItem struct {
+		SKU       string     `json:"sku" db:"sku"`
+		Quantity  int64      `json:"quantity" db:"quantity"`
+		UnitPrice MinorUnits `json:"unit_price" db:"unit_price"`
+	}
+)
+
+// orderItemsTotal validates the line items of a request and returns what
+// the order must be charged for them.
+func orderItemsTotal(items []OrderItem) (MinorUnits, error) {
+	if len(items) > maxOrderItems {
+		return 0, fmt.Errorf("Order must have at most %d items: got %d", maxOrderItems, len(items))
+	}
+
+	var total MinorUnits
+	for i, item := range items {
+		if item.SKU == "" {
+			return 0, fmt.Errorf("Order item %d sku must not be empty", i)
+		}
+		if item.Quantity <= 0 || item.Quantity > math.MaxInt32 {
+			return 0, fmt.Errorf("Order item %d quantity must be positive: got %d", i, item.Quantity)
+		}
+		if item.UnitPrice <= 0 {
+			return 0, fmt.Errorf("Order item %d unit price must be positive: got %d", i, item.UnitPrice)
+		}
+		if item.UnitPrice > MinorUnits(math.MaxInt64/item.Quantity) {
+			return 0, fmt.Errorf("Order item %d total is out of range", i)
+		}
+		line := item.UnitPrice * MinorUnits(item.Quantity)
+		if total > math.MaxInt64-line {
+			return 0, fmt.Errorf("Order total is out of range")
+		}
+		total += line
+	}
+	return total, nil
+}
+
+func getOrderItems(ctx context.Context, tx *sql.Tx, orderID int64) ([]OrderItem, error) {
+	rows, err := tx.QueryContext(ctx, getOrderItemsQuery, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []OrderItem
+	for rows.Next() {
+		var item OrderItem
+		if err := rows.Scan(&item.SKU, &item.Quantity, &item.UnitPrice); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
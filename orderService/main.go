@@ -15,6 +15,7 @@ import (
 	"github.com/antithesishq/antithesis-sdk-go/lifecycle"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/guergabo/demo/order-service/eventschema"
 	_ "github.com/lib/pq"
 )
 
@@ -30,6 +31,16 @@ func main() {
 	// dbUserPtr := flag.String("db-user", "orderuser", "Database username")
 	// dbPasswordPtr := flag.String("db-password", "orderpass", "Database password")
 	natsUrlPtr := flag.String("nats-url", "nats://nats:4222", "NATS server URL")
+	outboxBatchSizePtr := flag.Int("outbox-batch-size", defaultOutboxBatchSize, "Maximum outbox events relayed per transaction")
+	outboxPollIntervalPtr := flag.Duration("outbox-poll-interval", defaultOutboxPollInterval, "Interval of the fallback outbox sweep")
+	outboxMaxLatencyPtr := flag.Duration("outbox-max-latency", 10*time.Millisecond, "How long to batch outbox notifications before relaying")
+	outboxMaxAttemptsPtr := flag.Int("outbox-max-attempts", defaultOutboxMaxAttempts, "Publish attempts before an outbox event is marked failed")
+	outboxMaxInFlightPtr := flag.Int("outbox-max-in-flight", defaultOutboxMaxInFlight, "Maximum unacknowledged outbox publishes")
+	outboxArchiveAfterPtr := flag.Duration("outbox-archive-after", defaultArchiveAfter, "Age after which relayed outbox events are archived")
+	outboxRelayModePtr := flag.String("outbox-relay-mode", string(RelayModeConcurrent), "How replicas share the outbox: concurrent, leader or per_aggregate")
+	adminUsernamePtr := flag.String("admin-username", "admin", "Username of the outbox admin API")
+	adminPasswordPtr := flag.String("admin-password", "", "Password of the outbox admin API, which is disabled when empty")
+	flag.Parse()
 
 	assert.Always(true, "Instantiates an Order REST API", nil)
 
@@ -79,7 +90,28 @@ func main() {
 	// Order service setup.
 	log.Printf("Starting order service...\n")
 
-	orderService := NewOrderService(store.db, jetStreamStore.js)
+	listener, err := store.NewListener(OutboxChannel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer listener.Close()
+
+	schemas, err := eventschema.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	orderService := NewOrderService(store.db, jetStreamStore.js, OrderServiceConfig{
+		BatchSize:    *outboxBatchSizePtr,
+		PollInterval: *outboxPollIntervalPtr,
+		MaxLatency:   *outboxMaxLatencyPtr,
+		Listener:     listener,
+		MaxAttempts:  *outboxMaxAttemptsPtr,
+		MaxInFlight:  *outboxMaxInFlightPtr,
+		ArchiveAfter: *outboxArchiveAfterPtr,
+		RelayMode:    RelayMode(*outboxRelayModePtr),
+		Schemas:      schemas,
+	})
 	if err := orderService.Start(ctx); err != nil {
 		log.Fatal(err)
 	}
@@ -92,6 +124,12 @@ func main() {
 		w.Write([]byte("Health check successful.\n"))
 	})
 	r.Mount("/orders", orderService.Routes())
+	r.Post("/orders:batch", orderService.CreateBatch)
+	if *adminPasswordPtr != "" {
+		r.Mount("/admin/outbox", orderService.AdminRoutes(*adminUsernamePtr, *adminPasswordPtr))
+	} else {
+		log.Printf("Outbox admin API disabled: no admin password\n")
+	}
 
 	srv := &http.Server{
 		Addr:    ":8000",
@@ -11,6 +11,17 @@ import (
 	"github.com/nats-io/nats.go/jetstream"
 )
 
+const (
+	OrdersStream   = "ORDERS"
+	PaymentsStream = "PAYMENTS"
+
+	// DuplicateWindow is how long a stream remembers message IDs to drop
+	// republished messages. It must cover the time the order service's relay
+	// can take to retry an event after a crash, and be the same in every
+	// service that creates the streams.
+	DuplicateWindow = 10 * time.Minute
+)
+
 type (
 	NatsConfig struct {
 		URL       string
@@ -74,19 +85,24 @@ func NewJetStreamStore(config *NatsConfig) (*JetStreamStore, error) {
 }
 
 func (s *JetStreamStore) Start(ctx context.Context) error {
-	stream, err := s.js.CreateStream(ctx, jetstream.StreamConfig{
-		Name:     "ORDERS",
-		Subjects: []string{"ORDERS.*"},
-	})
-	if err != nil {
-		return err
-	}
-	info, err := stream.Info(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to get stream info: %w", err)
-	}
+	// ORDERS carries outbox events to the payment service, PAYMENTS carries
+	// the payment service's outcomes back.
+	for _, name := range []string{OrdersStream, PaymentsStream} {
+		stream, err := s.js.CreateStream(ctx, jetstream.StreamConfig{
+			Name:       name,
+			Subjects:   []string{name + ".*"},
+			Duplicates: DuplicateWindow,
+		})
+		if err != nil {
+			return err
+		}
+		info, err := stream.Info(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get stream info: %w", err)
+		}
 
-	log.Printf("%v\n", info.State)
+		log.Printf("%s: %v\n", name, info.State)
+	}
 	return nil
 }
 
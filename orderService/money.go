@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+var (
+	errSubMinorUnitPrecision = errors.New("amount must be a whole number of minor units")
+)
+
+type (
+	// MinorUnits is an exact amount of money in the smallest unit of its
+	// currency (e.g. cents for usd), which is also what Stripe charges in.
+	MinorUnits int64
+
+	// Money is an amount together with the ISO 4217 currency it is in.
+	Money struct {
+		Amount   MinorUnits `json:"amount" db:"amount"`
+		Currency string     `json:"currency" db:"currency"`
+	}
+)
+
+// UnmarshalJSON accepts any JSON number that is a whole number of minor
+// units, so 1050 and 1050.0 are fine but 1050.5 is rejected instead of being
+// silently rounded.
+func (m *MinorUnits) UnmarshalJSON(data []byte) error {
+	literal := string(bytes.TrimSpace(data))
+	if literal == "" || literal[0] == '"' || literal == "null" {
+		return fmt.Errorf("amount must be a JSON number: got %s", literal)
+	}
+	amount, ok := new(big.Rat).SetString(literal)
+	if !ok {
+		return fmt.Errorf("amount must be a JSON number: got %s", literal)
+	}
+	if !amount.IsInt() {
+		return fmt.Errorf("%w: got %s", errSubMinorUnitPrecision, literal)
+	}
+	if !amount.Num().IsInt64() {
+		return fmt.Errorf("amount is out of range: got %s", literal)
+	}
+	*m = MinorUnits(amount.Num().Int64())
+	return nil
+}
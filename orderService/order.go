@@ -3,22 +3,26 @@ package main
 // TODO: prepared statements.
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	_ "embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"reflect"
 	"strconv"
 	"time"
 
 	"github.com/antithesishq/antithesis-sdk-go/assert"
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
-	_ "github.com/lib/pq"
+	"github.com/guergabo/demo/order-service/eventschema"
+	"github.com/lib/pq"
+	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/jetstream"
 )
 
@@ -26,10 +30,33 @@ const (
 	OrderStatusPending   OrderStatus = "pending"
 	OrderStatusSucceeded OrderStatus = "succeeded"
 	OrderStatusFailed    OrderStatus = "failed"
+	OrderStatusCancelled OrderStatus = "cancelled"
+	OrderStatusRefunded  OrderStatus = "refunded"
 
 	OutboxStatusPending   OutboxStatus = "pending"
 	OutboxStatusSucceeded OutboxStatus = "succeeded"
 	OutboxStatusFailed    OutboxStatus = "failed"
+	OutboxStatusSkipped   OutboxStatus = "skipped"
+
+	AggregateTypeOrder = "Order"
+
+	EventTypeOrderCreated         = "ORDER_CREATED"
+	EventTypeOrderCancelled       = "ORDER_CANCELLED"
+	EventTypeOrderUpdated         = "ORDER_UPDATED"
+	EventTypeOrderRefundRequested = "ORDER_REFUND_REQUESTED"
+
+	// OutboxChannel is the channel order_outboxes inserts NOTIFY on.
+	OutboxChannel = "order_outbox"
+
+	defaultOutboxBatchSize    = 100
+	maxOutboxBatchSize        = 1000
+	defaultOutboxPollInterval = 5 * time.Second
+
+	defaultOutboxMaxAttempts     = 10
+	defaultOutboxRetryBackoff    = time.Second
+	defaultOutboxMaxRetryBackoff = 5 * time.Minute
+	defaultOutboxMaxInFlight     = 256
+	publishAckTimeout            = 5 * time.Second
 )
 
 var (
@@ -39,6 +66,15 @@ var (
 	//go:embed db/ops/order_get.sql
 	getOrderQuery string
 
+	//go:embed db/ops/order_get_for_update.sql
+	getOrderForUpdateQuery string
+
+	//go:embed db/ops/order_cancel.sql
+	cancelOrderQuery string
+
+	//go:embed db/ops/order_update.sql
+	updateOrderQuery string
+
 	//go:embed db/ops/order_list.sql
 	listOrderQuery string
 
@@ -47,6 +83,15 @@ var (
 
 	//go:embed db/ops/order_processed.sql
 	markOrderAsProcessedQuery string
+
+	//go:embed db/ops/order_skipped.sql
+	markOrderAsSkippedQuery string
+
+	//go:embed db/ops/order_retry.sql
+	markOrderForRetryQuery string
+
+	//go:embed db/ops/order_failed.sql
+	markOrderAsFailedQuery string
 )
 
 type (
@@ -54,15 +99,22 @@ type (
 
 	OutboxStatus string
 
+	// CustomerMetadata is free-form customer data stored as JSONB.
+	CustomerMetadata map[string]string
+
 	Order struct {
-		ID          int64       `json:"id" db:"id"`
-		Amount      float64     `json:"amount" db:"amount"`
-		Currency    string      `json:"currency" db:"currency"`
-		Customer    string      `json:"customer" db:"customer"`
-		Description string      `json:"description" db:"description"`
-		CreatedAt   int64       `json:"created_at" db:"created_at"`
-		UpdatedAt   *int64      `json:"updated_at,omitempty" db:"updated_at"`
-		Status      OrderStatus `json:"status" db:"status"`
+		ID int64 `json:"id" db:"id"`
+		Money
+		Customer         string           `json:"customer" db:"customer"`
+		Description      string           `json:"description" db:"description"`
+		CreatedAt        int64            `json:"created_at" db:"created_at"`
+		UpdatedAt        *int64           `json:"updated_at,omitempty" db:"updated_at"`
+		Status           OrderStatus      `json:"status" db:"status"`
+		CustomerMetadata CustomerMetadata `json:"customer_metadata" db:"customer_metadata"`
+		Version          int64            `json:"version" db:"version"`
+		ChargeID         *string          `json:"charge_id,omitempty" db:"charge_id"`
+		RefundedAmount   MinorUnits       `json:"refunded_amount" db:"refunded_amount"`
+		Items            []OrderItem      `json:"items,omitempty"`
 	}
 
 	OrderEvent struct {
@@ -71,19 +123,55 @@ type (
 		AggregateID   int64           `json:"aggregate_id" db:"aggregate_id"`
 		EventType     string          `json:"event_type" db:"event_type"`
 		EventPayload  json.RawMessage `json:"event_payload" db:"event_payload"`
+		SchemaVersion int             `json:"schema_version,omitempty" db:"schema_version"`
 		CreatedAt     int64           `json:"created_at" db:"created_at"`
 		ProcessedAt   *int64          `json:"processed_at,omitempty" db:"processed_at"`
 		Status        OutboxStatus    `json:"status" db:"status"`
+		Attempts      int             `json:"attempts" db:"attempts"`
+		LastError     *string         `json:"last_error,omitempty" db:"last_error"`
+		NextAttemptAt int64           `json:"next_attempt_at" db:"next_attempt_at"`
+		Seq           int64           `json:"seq,omitempty" db:"seq"`
+
+		// AggregateStatus is the current status of the order the event
+		// belongs to, and Subject the NATS subject outbox_routes maps the
+		// event to. Both are read alongside the event by the relay.
+		AggregateStatus OrderStatus `json:"aggregate_status,omitempty" db:"aggregate_status"`
+		Subject         string      `json:"subject,omitempty" db:"subject"`
 	}
 
 	CreateOrderRequest struct {
-		Amount      float64 `json:"amount"`
-		Currency    string  `json:"currency"`
-		Customer    string  `json:"customer"`
-		Description string  `json:"description"`
+		Money
+		Customer         string           `json:"customer"`
+		Description      string           `json:"description"`
+		CustomerMetadata CustomerMetadata `json:"customer_metadata,omitempty"`
+
+		// Items are optional. When present the service computes the amount
+		// from them, and a client-supplied amount must agree with it.
+		Items []OrderItem `json:"items,omitempty"`
+	}
+
+	UpdateOrderRequest struct {
+		Description      *string           `json:"description,omitempty"`
+		CustomerMetadata *CustomerMetadata `json:"customer_metadata,omitempty"`
+	}
+
+	// OrderCreatedPayload is the event_payload of ORDER_CREATED outbox events.
+	// It carries the order and event IDs so consumers can trace what they do
+	// back to the order.
+	OrderCreatedPayload struct {
+		OrderID   int64     `json:"order_id"`
+		EventID   uuid.UUID `json:"event_id"`
+		CreatedAt int64     `json:"created_at"`
+		Money
+		CurrencyExponent int         `json:"currency_exponent"`
+		Customer         string      `json:"customer"`
+		Description      string      `json:"description"`
+		Items            []OrderItem `json:"items"`
 	}
 
-	CreateOrderQueryResult struct {
+	// OrderQueryResult is the row returned by the statements that change an
+	// order and append its outbox event in one round trip.
+	OrderQueryResult struct {
 		Order      Order      `json:"order"`
 		OrderEvent OrderEvent `json:"order_event"`
 	}
@@ -92,27 +180,134 @@ type (
 		Order Order `json:"order"`
 	}
 
+	// OrderServiceConfig tunes the outbox relay. Zero values fall back to
+	// the defaults.
+	OrderServiceConfig struct {
+		// BatchSize is the maximum number of outbox events relayed per
+		// transaction.
+		BatchSize int
+
+		// PollInterval is how often the relay sweeps the outbox without being
+		// notified, to catch events whose notification was missed.
+		PollInterval time.Duration
+
+		// MaxLatency is how long the relay lets notifications accumulate
+		// before draining the outbox, trading latency for larger batches.
+		MaxLatency time.Duration
+
+		// Listener receives a notification whenever events are committed to
+		// the outbox. Without it the relay only polls.
+		Listener *pq.Listener
+
+		// MaxAttempts is how many times an event is published before it is
+		// marked failed and no longer relayed.
+		MaxAttempts int
+
+		// RetryBackoff is the delay before the first retry of an event. It
+		// doubles with every attempt, up to MaxRetryBackoff.
+		RetryBackoff    time.Duration
+		MaxRetryBackoff time.Duration
+
+		// MaxInFlight is the most events published and not yet acknowledged
+		// by JetStream at any time.
+		MaxInFlight int
+
+		// RelayMode decides how replicas share the outbox.
+		RelayMode RelayMode
+
+		// Schemas validates every payload before it is published. Events
+		// that do not conform are marked failed without being published.
+		Schemas *eventschema.Registry
+
+		// ArchiveAfter is how long relayed events stay in order_outboxes
+		// before the archival job, which runs every ArchiveInterval, moves
+		// them to order_outbox_archive, ArchiveBatchSize rows at a time.
+		ArchiveAfter     time.Duration
+		ArchiveInterval  time.Duration
+		ArchiveBatchSize int
+	}
+
 	OrderService struct {
-		db      *sql.DB
-		js      jetstream.JetStream
-		done    chan struct{}
-		started bool
+		db       *sql.DB
+		js       jetstream.JetStream
+		config   OrderServiceConfig
+		statuses *StatusBroadcaster
+		done     chan struct{}
+		started  bool
+	}
+
+	pendingPublish struct {
+		index  int
+		future jetstream.PubAckFuture
 	}
 
 	ProcessResult struct {
 		OrderOutbox OrderEvent
+		Skipped     bool
 		Error       error
+
+		// Rejected is set with Error when the event can never be published,
+		// so it is failed right away instead of retried.
+		Rejected bool
+	}
+
+	rowScanner interface {
+		Scan(dest ...any) error
 	}
 )
 
-func NewOrderService(db *sql.DB, js jetstream.JetStream) *OrderService {
+func NewOrderService(db *sql.DB, js jetstream.JetStream, config OrderServiceConfig) *OrderService {
 	assert.Always(db != nil, "DB must be instantiated", nil)
+	assert.Always(config.Schemas != nil, "Event schemas must be loaded", nil)
+
+	if config.BatchSize == 0 {
+		config.BatchSize = defaultOutboxBatchSize
+	}
+	if config.PollInterval == 0 {
+		config.PollInterval = defaultOutboxPollInterval
+	}
+	if config.RelayMode == "" {
+		config.RelayMode = RelayModeConcurrent
+	}
+	assert.Always(config.RelayMode.Valid(), "Relay mode must be known", Details{"relay_mode": config.RelayMode})
+	if config.MaxInFlight == 0 {
+		config.MaxInFlight = defaultOutboxMaxInFlight
+	}
+	if config.MaxAttempts == 0 {
+		config.MaxAttempts = defaultOutboxMaxAttempts
+	}
+	if config.RetryBackoff == 0 {
+		config.RetryBackoff = defaultOutboxRetryBackoff
+	}
+	if config.MaxRetryBackoff == 0 {
+		config.MaxRetryBackoff = defaultOutboxMaxRetryBackoff
+	}
+	if config.ArchiveAfter == 0 {
+		config.ArchiveAfter = defaultArchiveAfter
+	}
+	if config.ArchiveInterval == 0 {
+		config.ArchiveInterval = defaultArchiveInterval
+	}
+	if config.ArchiveBatchSize == 0 {
+		config.ArchiveBatchSize = defaultArchiveBatchSize
+	}
+	assert.Always(config.ArchiveAfter > 0 && config.ArchiveInterval > 0 && config.ArchiveBatchSize > 0, "Archival settings must be positive", Details{
+		"archive_after":      config.ArchiveAfter,
+		"archive_interval":   config.ArchiveInterval,
+		"archive_batch_size": config.ArchiveBatchSize,
+	})
+	assert.Always(config.MaxInFlight > 0, "Max in-flight publishes must be positive", Details{"max_in_flight": config.MaxInFlight})
+	assert.Always(config.MaxAttempts > 0, "Max attempts must be positive", Details{"max_attempts": config.MaxAttempts})
+	assert.Always(config.BatchSize > 0 && config.BatchSize <= maxOutboxBatchSize, "Batch size must be between 1 and the maximum", Details{"batch_size": config.BatchSize})
+	assert.Always(config.PollInterval > 0 && config.MaxLatency >= 0, "Relay intervals must not be negative", Details{"poll_interval": config.PollInterval, "max_latency": config.MaxLatency})
 
 	return &OrderService{
-		db:      db,
-		js:      js,
-		done:    make(chan struct{}),
-		started: false,
+		db:       db,
+		js:       js,
+		config:   config,
+		statuses: NewStatusBroadcaster(),
+		done:     make(chan struct{}),
+		started:  false,
 	}
 }
 
@@ -120,8 +315,17 @@ func (s *OrderService) Start(ctx context.Context) error {
 	if s.started {
 		return fmt.Errorf("Service already started")
 	}
+	consumer, err := s.js.CreateOrUpdateConsumer(ctx, PaymentsStream, jetstream.ConsumerConfig{
+		Durable:   paymentsConsumer,
+		AckPolicy: jetstream.AckExplicitPolicy,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create payments consumer: %w", err)
+	}
 	s.started = true
-	go s.processOutboxEvents(ctx, 100) // TODO: configuration.
+	go s.processOutboxEvents(ctx)
+	go s.consumePaymentEvents(ctx, consumer)
+	go s.archiveOutboxEvents(ctx)
 	return nil
 }
 
@@ -139,6 +343,11 @@ func (s *OrderService) Routes() chi.Router {
 	r.Post("/", s.Create)
 	r.Route("/{orderID}", func(r chi.Router) {
 		r.Get("/", s.Get)
+		r.Patch("/", s.Update)
+		r.Post("/cancel", s.Cancel)
+		r.Get("/watch", s.Watch)
+		r.Post("/refunds", s.CreateRefund)
+		r.Get("/refunds", s.ListRefunds)
 	})
 	r.Get("/", s.List)
 	return r
@@ -156,24 +365,25 @@ func (s *OrderService) Create(w http.ResponseWriter, r *http.Request) {
 
 	var req CreateOrderRequest
 	if err := json.Unmarshal(body, &req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		assert.Sometimes(errors.Is(err, errSubMinorUnitPrecision), "Sometimes an order amount has sub-minor-unit precision", nil)
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
 		return
 	}
 
-	if req.Amount <= 0 {
-		http.Error(w, fmt.Sprintf("Order amount must be positive: got %v", req.Amount), http.StatusBadRequest)
-		return
-	}
-	if req.Currency != "usd" {
-		http.Error(w, fmt.Sprintf("Order currency must be usd: got %v", req.Currency), http.StatusBadRequest)
+	currency, err := req.Validate()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if req.Customer == "" {
-		http.Error(w, fmt.Sprintf("Order customer id must not be empty"), http.StatusBadRequest)
+
+	idempotencyKey := r.Header.Get(IdempotencyKeyHeader)
+	if len(idempotencyKey) > maxIdempotencyKeyLength {
+		http.Error(w, fmt.Sprintf("Idempotency key must be at most %d characters", maxIdempotencyKeyLength), http.StatusBadRequest)
 		return
 	}
-	if req.Description == "" {
-		http.Error(w, fmt.Sprintf("Order description must not be empty"), http.StatusBadRequest)
+	requestHash, err := hashCreateOrderRequest(req)
+	if err != nil {
+		http.Error(w, "Failed to hash request body", http.StatusInternalServerError)
 		return
 	}
 
@@ -186,78 +396,196 @@ func (s *OrderService) Create(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
-	row := tx.QueryRowContext(
-		r.Context(),
-		createOrderQuery,
+	var idempotencyKeyParam, requestHashParam sql.NullString
+	if idempotencyKey != "" {
+		record, err := getIdempotencyKey(r.Context(), tx, idempotencyKey)
+		if err != nil {
+			http.Error(w, "Failed to get idempotency key", http.StatusInternalServerError)
+			return
+		}
+		assert.Sometimes(record != nil, "Sometimes a create order request is a retry of an earlier request", nil)
+		if record != nil {
+			s.replayCreate(w, r, tx, record, requestHash)
+			return
+		}
+		idempotencyKeyParam = sql.NullString{String: idempotencyKey, Valid: true}
+		requestHashParam = sql.NullString{String: requestHash, Valid: true}
+	}
+
+	stmt, err := tx.PrepareContext(r.Context(), createOrderQuery)
+	if err != nil {
+		http.Error(w, "Failed to prepare statement", http.StatusInternalServerError)
+		return
+	}
+	defer stmt.Close()
+
+	order, err := insertOrder(r.Context(), stmt, req, currency, idempotencyKeyParam, requestHashParam)
+	if err != nil {
+		if isIdempotencyKeyViolation(err) {
+			tx.Rollback()
+			s.replayConcurrentCreate(w, r, idempotencyKey, requestHash)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to serialize response: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, "Failed to serialize response", http.StatusInternalServerError)
+		return
+	}
+
+	out, err := json.Marshal(order)
+	if err != nil {
+		http.Error(w, "Failed to serialize response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(ETagHeader, orderETag(order.Version))
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(out)
+}
+
+// Validate checks a create request with the rules shared by every way of
+// creating orders. It normalizes req in place (amount computed from items,
+// lowercase currency) and returns the currency the order is placed in.
+func (req *CreateOrderRequest) Validate() (Currency, error) {
+	if len(req.Items) > 0 {
+		total, err := orderItemsTotal(req.Items)
+		if err != nil {
+			return Currency{}, err
+		}
+		if req.Amount != 0 && req.Amount != total {
+			return Currency{}, fmt.Errorf("Order amount must match the items total: got %d, want %d", req.Amount, total)
+		}
+		req.Amount = total
+	}
+	if req.Items == nil {
+		req.Items = []OrderItem{}
+	}
+	if req.Amount <= 0 {
+		return Currency{}, fmt.Errorf("Order amount must be positive: got %v", req.Amount)
+	}
+	currency, err := lookupCurrency(req.Currency)
+	if err != nil {
+		return Currency{}, err
+	}
+	req.Currency = currency.Code
+	if err := currency.ValidateAmount(req.Amount); err != nil {
+		return Currency{}, err
+	}
+	if req.Customer == "" {
+		return Currency{}, fmt.Errorf("Order customer id must not be empty")
+	}
+	if req.Description == "" {
+		return Currency{}, fmt.Errorf("Order description must not be empty")
+	}
+	return currency, nil
+}
+
+// insertOrder runs the prepared order_create.sql for a validated request and
+// checks the invariants of the order and outbox rows it wrote.
+func insertOrder(ctx context.Context, stmt *sql.Stmt, req CreateOrderRequest, currency Currency, idempotencyKey, requestHash sql.NullString) (Order, error) {
+	items, err := json.Marshal(req.Items)
+	if err != nil {
+		return Order{}, fmt.Errorf("failed to serialize order items: %w", err)
+	}
+	// The event ID is chosen up front because the payload embeds it.
+	eventID := uuid.New()
+
+	row := stmt.QueryRowContext(
+		ctx,
 		req.Amount,
 		req.Currency,
 		req.Customer,
 		req.Description,
 		time.Now().Unix(),
+		idempotencyKey,
+		requestHash,
+		http.StatusAccepted,
+		req.CustomerMetadata,
+		currency.Exponent,
+		items,
+		eventID,
 	)
 
-	var result CreateOrderQueryResult
-	err = row.Scan(
-		&result.Order.ID,
-		&result.Order.Amount,
-		&result.Order.Currency,
-		&result.Order.Customer,
-		&result.Order.Description,
-		&result.Order.CreatedAt,
-		&result.Order.UpdatedAt,
-		&result.Order.Status,
-		&result.OrderEvent.ID,
-		&result.OrderEvent.AggregateType,
-		&result.OrderEvent.AggregateID,
-		&result.OrderEvent.EventType,
-		&result.OrderEvent.EventPayload,
-		&result.OrderEvent.CreatedAt,
-		&result.OrderEvent.ProcessedAt,
-		&result.OrderEvent.Status,
-	)
+	result, err := scanOrderQueryResult(row)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to serialize response: %v", err), http.StatusInternalServerError)
-		return
+		return Order{}, err
 	}
 
 	assert.AlwaysOrUnreachable(result.Order.UpdatedAt == nil, "New orders must have a null updated_at", Details{"updated_at": result.Order.UpdatedAt})
 	assert.AlwaysOrUnreachable(result.Order.Status == OrderStatusPending, "New orders must have a pending status", Details{"status": result.Order.Status})
-	assert.AlwaysOrUnreachable(result.OrderEvent.AggregateType == "Order", "Event must go to the order topic", Details{"aggregate_type": result.OrderEvent.AggregateType}) // BUG: {aggregate_type:orders}
+	assert.AlwaysOrUnreachable(result.Order.Version == 1, "New orders must start at version 1", Details{"version": result.Order.Version})
+	assert.AlwaysOrUnreachable(result.OrderEvent.AggregateType == AggregateTypeOrder, "Event must go to the order topic", Details{"aggregate_type": result.OrderEvent.AggregateType})
 	assert.AlwaysOrUnreachable(result.OrderEvent.AggregateID == result.Order.ID, "AggregateID must map to orderID", nil)
-	assert.AlwaysOrUnreachable(result.OrderEvent.EventType == "ORDER_CREATED", "New order events must have ORDER_CREATED eventy type", nil)
-
-	expectedPayload, err := json.Marshal(map[string]interface{}{
-		"amount":      req.Amount,
-		"currency":    req.Currency,
-		"customer":    req.Customer,
-		"description": req.Description,
-	})
-	assert.AlwaysOrUnreachable(err == nil, "Must be able to marshal expected payload", Details{"error": err})
-	// BUG:  .00
-	assert.AlwaysOrUnreachable(bytes.Equal(result.OrderEvent.EventPayload, expectedPayload),
+	assert.AlwaysOrUnreachable(result.OrderEvent.EventType == EventTypeOrderCreated, "New order events must have ORDER_CREATED eventy type", nil)
+	assert.AlwaysOrUnreachable(result.OrderEvent.ID == eventID, "New order events must have the chosen ID", Details{"expected": eventID, "actual": result.OrderEvent.ID})
+
+	expectedPayload := OrderCreatedPayload{
+		OrderID:          result.Order.ID,
+		EventID:          eventID,
+		CreatedAt:        result.Order.CreatedAt,
+		Money:            req.Money,
+		CurrencyExponent: currency.Exponent,
+		Customer:         req.Customer,
+		Description:      req.Description,
+		Items:            req.Items,
+	}
+	var actualPayload OrderCreatedPayload
+	err = json.Unmarshal(result.OrderEvent.EventPayload, &actualPayload)
+	assert.AlwaysOrUnreachable(err == nil, "Must be able to unmarshal event payload", Details{"error": err})
+	assert.AlwaysOrUnreachable(reflect.DeepEqual(actualPayload, expectedPayload),
 		"Event payload must match expected payload",
 		Details{
 			"actual_payload":   string(result.OrderEvent.EventPayload),
-			"expected_payload": string(expectedPayload),
+			"expected_payload": expectedPayload,
 		})
 	assert.AlwaysOrUnreachable(result.OrderEvent.ProcessedAt == nil, "New order events must have a null processed_at", nil)
 	assert.AlwaysOrUnreachable(result.OrderEvent.Status == OutboxStatusPending, "New order events must have a pending status", nil)
 
-	if err = tx.Commit(); err != nil {
-		http.Error(w, "Failed to serialize response", http.StatusInternalServerError)
+	order := result.Order
+	order.Items = req.Items
+	return order, nil
+}
+
+func (s *OrderService) Get(w http.ResponseWriter, r *http.Request) {
+	assert.Always(s.started, "Service must be started before handling requests", Details{"op": "get_order"})
+
+	orderIDURLParam := chi.URLParam(r, "orderID")
+	orderID, err := strconv.Atoi(orderIDURLParam)
+	if err != nil {
+		http.Error(w, "Failed to to process orderID", http.StatusBadRequest)
+		return
+	}
+	assert.Sometimes(orderID%2 == 0, "Somestimes the order serivce gets an even orderID", nil)
+	assert.Sometimes(orderID%2 == 1, "Sometimes the order service gets an odd orderID", nil)
+
+	tx, err := s.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Failed to begin transaction", http.StatusInternalServerError)
 		return
 	}
+	defer tx.Rollback()
 
-	order := Order{
-		ID:          result.Order.ID,
-		Amount:      result.Order.Amount,
-		Currency:    result.Order.Currency,
-		Customer:    result.Order.Customer,
-		Description: result.Order.Description,
-		CreatedAt:   result.Order.CreatedAt,
-		UpdatedAt:   result.Order.UpdatedAt,
-		Status:      result.Order.Status,
+	order, err := getOrder(r.Context(), tx, int64(orderID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to get order", http.StatusInternalServerError)
+		return
+	}
+
+	assert.AlwaysOrUnreachable(order.Amount > 0, "Retrieved order must have positive amount", Details{"amount": order.Amount})
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, "Failed to commit transaction", http.StatusInternalServerError)
+		return
 	}
+
 	out, err := json.Marshal(order)
 	if err != nil {
 		http.Error(w, "Failed to serialize response", http.StatusInternalServerError)
@@ -265,12 +593,13 @@ func (s *OrderService) Create(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusAccepted)
+	w.Header().Set(ETagHeader, orderETag(order.Version))
+	w.WriteHeader(http.StatusOK)
 	w.Write(out)
 }
 
-func (s *OrderService) Get(w http.ResponseWriter, r *http.Request) {
-	assert.Always(s.started, "Service must be started before handling requests", Details{"op": "get_order"})
+func (s *OrderService) Cancel(w http.ResponseWriter, r *http.Request) {
+	assert.Always(s.started, "Service must be started before handling requests", Details{"op": "cancel_order"})
 
 	orderIDURLParam := chi.URLParam(r, "orderID")
 	orderID, err := strconv.Atoi(orderIDURLParam)
@@ -278,8 +607,6 @@ func (s *OrderService) Get(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to to process orderID", http.StatusBadRequest)
 		return
 	}
-	assert.Sometimes(orderID%2 == 0, "Somestimes the order serivce gets an even orderID", nil)
-	assert.Sometimes(orderID%2 == 1, "Sometimes the order service gets an odd orderID", nil)
 
 	tx, err := s.db.BeginTx(r.Context(), nil)
 	if err != nil {
@@ -288,14 +615,7 @@ func (s *OrderService) Get(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
-	var order Order
-	err = tx.QueryRowContext(r.Context(), getOrderQuery, orderID).Scan(
-		&order.ID,
-		&order.Amount,
-		&order.CreatedAt,
-		&order.UpdatedAt,
-		&order.Status,
-	)
+	order, err := scanOrder(tx.QueryRowContext(r.Context(), getOrderForUpdateQuery, orderID))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			http.Error(w, "Order not found", http.StatusNotFound)
@@ -305,26 +625,95 @@ func (s *OrderService) Get(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	assert.AlwaysOrUnreachable(order.Amount > 0, "Retrieved order must have positive amount", Details{"amount": order.Amount})
+	if err := order.Status.Transition(OrderStatusCancelled); err != nil {
+		assert.Reachable("Orders that already settled cannot be cancelled", Details{"status": order.Status})
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	result, err := scanOrderQueryResult(tx.QueryRowContext(
+		r.Context(),
+		cancelOrderQuery,
+		orderID,
+		time.Now().Unix(),
+		order.Status,
+	))
+	if err != nil {
+		http.Error(w, "Failed to cancel order", http.StatusInternalServerError)
+		return
+	}
+	result.Order.Items, err = getOrderItems(r.Context(), tx, result.Order.ID)
+	if err != nil {
+		http.Error(w, "Failed to get order items", http.StatusInternalServerError)
+		return
+	}
+
+	assert.AlwaysOrUnreachable(result.Order.Status == OrderStatusCancelled, "Cancelled orders must have a cancelled status", Details{"status": result.Order.Status})
+	assert.AlwaysOrUnreachable(result.Order.UpdatedAt != nil, "Cancelled orders must have an updated_at", nil)
+	assert.AlwaysOrUnreachable(result.Order.Version == order.Version+1, "Cancelling an order must bump its version", Details{"before": order.Version, "after": result.Order.Version})
+	assert.AlwaysOrUnreachable(result.OrderEvent.AggregateID == result.Order.ID, "AggregateID must map to orderID", nil)
+	assert.AlwaysOrUnreachable(result.OrderEvent.EventType == EventTypeOrderCancelled, "Cancelled order events must have ORDER_CANCELLED event type", nil)
+	assert.AlwaysOrUnreachable(result.OrderEvent.Status == OutboxStatusPending, "New order events must have a pending status", nil)
 
 	if err = tx.Commit(); err != nil {
 		http.Error(w, "Failed to commit transaction", http.StatusInternalServerError)
 		return
 	}
+	s.statuses.Publish(result.Order.ID)
 
-	out, err := json.Marshal(order)
+	out, err := json.Marshal(result.Order)
 	if err != nil {
 		http.Error(w, "Failed to serialize response", http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(ETagHeader, orderETag(result.Order.Version))
 	w.WriteHeader(http.StatusOK)
 	w.Write(out)
 }
 
-func (s *OrderService) List(w http.ResponseWriter, r *http.Request) {
-	assert.Always(s.started, "Service must be started before handling requests", Details{"op": "get_order"})
+func (s *OrderService) Update(w http.ResponseWriter, r *http.Request) {
+	assert.Always(s.started, "Service must be started before handling requests", Details{"op": "update_order"})
+
+	orderIDURLParam := chi.URLParam(r, "orderID")
+	orderID, err := strconv.Atoi(orderIDURLParam)
+	if err != nil {
+		http.Error(w, "Failed to to process orderID", http.StatusBadRequest)
+		return
+	}
+
+	ifMatch := r.Header.Get(IfMatchHeader)
+	if ifMatch == "" {
+		http.Error(w, "Order updates require an If-Match header", http.StatusPreconditionRequired)
+		return
+	}
+	expectedVersion, err := parseIfMatch(ifMatch)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	var req UpdateOrderRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Description == nil && req.CustomerMetadata == nil {
+		http.Error(w, "Order update must change description or customer_metadata", http.StatusBadRequest)
+		return
+	}
+	if req.Description != nil && *req.Description == "" {
+		http.Error(w, "Order description must not be empty", http.StatusBadRequest)
+		return
+	}
 
 	tx, err := s.db.BeginTx(r.Context(), nil)
 	if err != nil {
@@ -333,27 +722,96 @@ func (s *OrderService) List(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
-	var orders []Order
-	rows, err := tx.QueryContext(r.Context(), listOrderQuery)
+	order, err := scanOrder(tx.QueryRowContext(r.Context(), getOrderForUpdateQuery, orderID))
 	if err != nil {
-		if err != sql.ErrNoRows {
-			http.Error(w, "Failed to get orders", http.StatusInternalServerError)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Order not found", http.StatusNotFound)
 			return
 		}
+		http.Error(w, "Failed to get order", http.StatusInternalServerError)
+		return
+	}
+
+	assert.Sometimes(order.Version != expectedVersion, "Sometimes an order update is made against a stale version", Details{"current": order.Version, "expected": expectedVersion})
+	if order.Version != expectedVersion {
+		w.Header().Set(ETagHeader, orderETag(order.Version))
+		http.Error(w, "Order was modified since it was read", http.StatusPreconditionFailed)
+		return
+	}
+
+	var description sql.NullString
+	if req.Description != nil {
+		description = sql.NullString{String: *req.Description, Valid: true}
+	}
+
+	result, err := scanOrderQueryResult(tx.QueryRowContext(
+		r.Context(),
+		updateOrderQuery,
+		orderID,
+		description,
+		req.CustomerMetadata,
+		time.Now().Unix(),
+		expectedVersion,
+	))
+	if err != nil {
+		http.Error(w, "Failed to update order", http.StatusInternalServerError)
+		return
+	}
+	result.Order.Items, err = getOrderItems(r.Context(), tx, result.Order.ID)
+	if err != nil {
+		http.Error(w, "Failed to get order items", http.StatusInternalServerError)
+		return
+	}
+
+	assert.AlwaysOrUnreachable(result.Order.Version == expectedVersion+1, "Updating an order must bump its version", Details{"before": expectedVersion, "after": result.Order.Version})
+	assert.AlwaysOrUnreachable(result.Order.UpdatedAt != nil, "Updated orders must have an updated_at", nil)
+	assert.AlwaysOrUnreachable(result.OrderEvent.AggregateID == result.Order.ID, "AggregateID must map to orderID", nil)
+	assert.AlwaysOrUnreachable(result.OrderEvent.EventType == EventTypeOrderUpdated, "Updated order events must have ORDER_UPDATED event type", nil)
+	assert.AlwaysOrUnreachable(result.OrderEvent.Status == OutboxStatusPending, "New order events must have a pending status", nil)
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, "Failed to commit transaction", http.StatusInternalServerError)
+		return
+	}
+
+	out, err := json.Marshal(result.Order)
+	if err != nil {
+		http.Error(w, "Failed to serialize response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(ETagHeader, orderETag(result.Order.Version))
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+}
+
+func (s *OrderService) List(w http.ResponseWriter, r *http.Request) {
+	assert.Always(s.started, "Service must be started before handling requests", Details{"op": "list_orders"})
+
+	filter, err := parseListOrdersFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
+	tx, err := s.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Failed to begin transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	orders := make([]Order, 0, filter.Limit+1)
+	rows, err := tx.QueryContext(r.Context(), listOrderQuery, filter.args()...)
+	if err != nil {
+		http.Error(w, "Failed to get orders", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
 	for rows.Next() {
-		var order Order
-		err = rows.Scan(
-			&order.ID,
-			&order.Amount,
-			&order.Currency,
-			&order.Customer,
-			&order.Description,
-			&order.CreatedAt,
-			&order.UpdatedAt,
-			&order.Status,
-		)
+		order, err := scanOrder(rows)
 		if err != nil {
 			http.Error(w, "Failed to scan order", http.StatusInternalServerError)
 			return
@@ -366,16 +824,24 @@ func (s *OrderService) List(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("Number of orders: %d\n", len(orders))
+	response := ListOrdersResponse{Orders: orders}
+	if len(orders) > filter.Limit {
+		response.Orders = orders[:filter.Limit]
+		last := response.Orders[len(response.Orders)-1]
+		response.NextCursor = OrderCursor{CreatedAt: last.CreatedAt, ID: last.ID}.Encode()
+	}
+
+	log.Printf("Number of orders: %d\n", len(response.Orders))
 
-	assert.AlwaysOrUnreachable(len(orders) >= 0, "Retrieved number of orders must be a non-negative amount", Details{"length": len(orders)})
+	assert.AlwaysOrUnreachable(len(response.Orders) >= 0, "Retrieved number of orders must be a non-negative amount", Details{"length": len(response.Orders)})
+	assert.AlwaysOrUnreachable(len(response.Orders) <= filter.Limit, "Page size limit must be respected", Details{"length": len(response.Orders), "limit": filter.Limit})
 
 	if err = tx.Commit(); err != nil {
 		http.Error(w, "Failed to commit transaction", http.StatusInternalServerError)
 		return
 	}
 
-	out, err := json.Marshal(orders)
+	out, err := json.Marshal(response)
 	if err != nil {
 		http.Error(w, "Failed to serialize response", http.StatusInternalServerError)
 		return
@@ -386,77 +852,215 @@ func (s *OrderService) List(w http.ResponseWriter, r *http.Request) {
 	w.Write(out)
 }
 
-func (s *OrderService) processOutboxEvents(ctx context.Context, batchSize int) {
+func getOrder(ctx context.Context, tx *sql.Tx, orderID int64) (Order, error) {
+	order, err := scanOrder(tx.QueryRowContext(ctx, getOrderQuery, orderID))
+	if err != nil {
+		return order, err
+	}
+	order.Items, err = getOrderItems(ctx, tx, orderID)
+	return order, err
+}
+
+func (m CustomerMetadata) Value() (driver.Value, error) {
+	if m == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(m)
+}
+
+func (m *CustomerMetadata) Scan(src any) error {
+	raw, ok := src.([]byte)
+	if !ok {
+		return fmt.Errorf("unsupported customer metadata type: %T", src)
+	}
+	return json.Unmarshal(raw, m)
+}
+
+func scanOrder(row rowScanner) (Order, error) {
+	var order Order
+	err := row.Scan(
+		&order.ID,
+		&order.Amount,
+		&order.Currency,
+		&order.Customer,
+		&order.Description,
+		&order.CreatedAt,
+		&order.UpdatedAt,
+		&order.Status,
+		&order.CustomerMetadata,
+		&order.Version,
+		&order.ChargeID,
+		&order.RefundedAmount,
+	)
+	return order, err
+}
+
+func scanOrderQueryResult(row rowScanner) (OrderQueryResult, error) {
+	var result OrderQueryResult
+	err := row.Scan(
+		&result.Order.ID,
+		&result.Order.Amount,
+		&result.Order.Currency,
+		&result.Order.Customer,
+		&result.Order.Description,
+		&result.Order.CreatedAt,
+		&result.Order.UpdatedAt,
+		&result.Order.Status,
+		&result.Order.CustomerMetadata,
+		&result.Order.Version,
+		&result.Order.ChargeID,
+		&result.Order.RefundedAmount,
+		&result.OrderEvent.ID,
+		&result.OrderEvent.AggregateType,
+		&result.OrderEvent.AggregateID,
+		&result.OrderEvent.EventType,
+		&result.OrderEvent.EventPayload,
+		&result.OrderEvent.CreatedAt,
+		&result.OrderEvent.ProcessedAt,
+		&result.OrderEvent.Status,
+	)
+	return result, err
+}
+
+// processOutboxEvents relays the outbox until the service is stopped. It
+// drains the outbox whenever the listener reports new events, and on every
+// PollInterval as a fallback. In leader mode, replicas that are not the
+// leader try to take over on every wake-up instead.
+func (s *OrderService) processOutboxEvents(ctx context.Context) {
 	assert.Always(s.started, "Service must be started before processing outbox events", Details{"op": "process_outbox_events"})
-	assert.Always(batchSize > 0 && batchSize <= 100, "Batch size must be between 1 and 100", Details{"batch_size": batchSize})
 
-	ticker := time.NewTicker(5 * time.Second)
+	ticker := time.NewTicker(s.config.PollInterval)
 	defer ticker.Stop()
 
+	var notifications <-chan *pq.Notification
+	if s.config.Listener != nil {
+		notifications = s.config.Listener.Notify
+	}
+
+	var leadership *relayLeadership
+	if s.config.RelayMode == RelayModeLeader {
+		leadership = &relayLeadership{db: s.db}
+		defer leadership.release()
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-s.done:
 			return
-		case <-ticker.C:
-			if err := s.processNextBatch(ctx, batchSize); err != nil {
-				log.Printf("Error processing batch: %v\n", err)
+		case <-notifications:
+			if !s.awaitMoreNotifications(ctx, notifications) {
+				return
 			}
+		case <-ticker.C:
+		}
+		s.drainOutbox(ctx, leadership)
+	}
+}
+
+// awaitMoreNotifications waits up to MaxLatency so that events committed
+// shortly after each other are relayed in one batch, and swallows the
+// notifications received meanwhile. It returns false once the service stops.
+func (s *OrderService) awaitMoreNotifications(ctx context.Context, notifications <-chan *pq.Notification) bool {
+	if s.config.MaxLatency > 0 {
+		timer := time.NewTimer(s.config.MaxLatency)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return false
+		case <-s.done:
+			return false
+		case <-timer.C:
+		}
+	}
+	for {
+		select {
+		case <-notifications:
+		default:
+			return true
+		}
+	}
+}
+
+// drainOutbox relays batches until one comes back short, so a burst larger
+// than BatchSize does not wait for the next wake-up. In leader mode it checks
+// leadership before every batch, so a leader whose lock connection dropped
+// stops draining instead of relaying alongside the replica that took over.
+func (s *OrderService) drainOutbox(ctx context.Context, leadership *relayLeadership) {
+	for {
+		if leadership != nil && !leadership.acquire(ctx) {
+			return
+		}
+		processed, err := s.processNextBatch(ctx)
+		if err != nil {
+			log.Printf("Error processing batch: %v\n", err)
+			return
+		}
+		if processed < s.config.BatchSize {
+			return
 		}
 	}
 }
 
-func (s *OrderService) processNextBatch(ctx context.Context, batchSize int) error { // TODO: batch properly.
+// processNextBatch relays up to BatchSize events in one transaction and
+// returns how many of them are done with. Failed events are not counted, so a
+// failing batch does not keep drainOutbox spinning.
+func (s *OrderService) processNextBatch(ctx context.Context) (int, error) {
 	assert.Always(s.started, "Service must be started before processing next batch", Details{"op": "process_next_batch"})
-	assert.Always(batchSize > 0 && batchSize <= 100, "Batch size must be between 1 and 100", Details{"batch_size": batchSize})
+	batchSize := s.config.BatchSize
 
 	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		// When the connection has been closed or terminated unexpectedly.
 		// The "EOF" (End of File) error indicates that the connection was terminated while trying to read from it.
-		return fmt.Errorf("failed to start transaction: %w", err)
+		return 0, fmt.Errorf("failed to start transaction: %w", err)
 	}
 	defer tx.Rollback()
 
 	unprocessedEvents, err := s.dequeueUnprocessedEvents(ctx, tx, batchSize)
 	if err != nil {
-		return fmt.Errorf("failed to dequeue unprocessed events: %w", err)
+		return 0, fmt.Errorf("failed to dequeue unprocessed events: %w", err)
 	}
 
 	results, err := s.processEvents(ctx, tx, unprocessedEvents)
 	if err != nil {
-		return fmt.Errorf("failed to process events: %w", err)
+		return 0, fmt.Errorf("failed to process events: %w", err)
 	}
 
 	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("failed to commit transaction: %w", err)
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
 	if len(results) == 0 {
-		return nil
+		return 0, nil
 	}
 
 	// Log summary statistics.
 
 	successCount := 0
 	failureCount := 0
+	skippedCount := 0
 	for _, result := range results {
 		if result.Error != nil {
 			log.Printf("Process result %v failed: %v", result.OrderOutbox.ID, result.Error)
 			failureCount++
 			continue
 		}
+		if result.Skipped {
+			skippedCount++
+			continue
+		}
 		successCount++
 	}
-	assert.AlwaysOrUnreachable(len(results) == (successCount+failureCount), "", nil)
+	assert.AlwaysOrUnreachable(len(results) == (successCount+failureCount+skippedCount), "", nil)
 
-	log.Printf("Batch processing completed: %d succeeded, %d failed\n", successCount, failureCount)
-	return nil
+	log.Printf("Batch processing completed: %d succeeded, %d failed, %d skipped\n", successCount, failureCount, skippedCount)
+	return successCount + skippedCount, nil
 }
 
 func (s *OrderService) dequeueUnprocessedEvents(ctx context.Context, tx *sql.Tx, batchSize int) ([]OrderEvent, error) {
-	rows, err := tx.QueryContext(ctx, getUnprocessedOrdersQuery, batchSize)
+	rows, err := tx.QueryContext(ctx, s.config.RelayMode.dequeueQuery(), batchSize, time.Now().Unix())
 	if err != nil {
 		return nil, fmt.Errorf("failed to query unprocessed orders: %w", err)
 	}
@@ -473,6 +1077,12 @@ func (s *OrderService) dequeueUnprocessedEvents(ctx context.Context, tx *sql.Tx,
 			&event.CreatedAt,
 			&event.ProcessedAt,
 			&event.Status,
+			&event.Attempts,
+			&event.LastError,
+			&event.NextAttemptAt,
+			&event.SchemaVersion,
+			&event.AggregateStatus,
+			&event.Subject,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan order: %w", err)
@@ -505,61 +1115,224 @@ func (s *OrderService) dequeueUnprocessedEvents(ctx context.Context, tx *sql.Tx,
 	return orderEvents, nil
 }
 
+// processEvents publishes the batch asynchronously, keeping at most
+// MaxInFlight messages unacknowledged, then marks all acknowledged events and
+// all skipped events with one statement each. Events that failed to publish
+// are scheduled for a retry one by one, which should be rare, and events whose
+// payload does not conform to its schema are failed.
 func (s *OrderService) processEvents(ctx context.Context, tx *sql.Tx, unprocessedEvents []OrderEvent) ([]ProcessResult, error) {
 	if len(unprocessedEvents) == 0 {
 		return nil, nil
 	}
-	results := make([]ProcessResult, 0, len(unprocessedEvents))
+	results := make([]ProcessResult, len(unprocessedEvents))
 	log.Printf("Processing a batch of %d order events...\n", len(unprocessedEvents))
 
-	for _, event := range unprocessedEvents {
-		result := s.processEvent(ctx, tx, event)
-		results = append(results, result)
+	var (
+		skipped   []uuid.UUID
+		published []uuid.UUID
+		inFlight  []pendingPublish
+	)
+	await := func(p pendingPublish) {
+		if err := s.awaitPublish(ctx, unprocessedEvents[p.index], p.future); err != nil {
+			results[p.index].Error = fmt.Errorf("failed to process order: %w", err)
+			return
+		}
+		published = append(published, unprocessedEvents[p.index].ID)
+	}
+
+	for i, event := range unprocessedEvents {
+		results[i] = ProcessResult{OrderOutbox: event}
+
+		if !event.AggregateStatus.shouldRelay(event.EventType) {
+			log.Printf("Skipping order event %v: order %d is %s\n", event.ID, event.AggregateID, event.AggregateStatus)
+			results[i].Skipped = true
+			skipped = append(skipped, event.ID)
+			continue
+		}
+
+		if err := s.config.Schemas.Validate(event.EventType, event.SchemaVersion, event.EventPayload); err != nil {
+			assert.Unreachable("Outbox event payloads must conform to their schema", Details{"event_id": event.ID, "error": err.Error()})
+			results[i].Error = fmt.Errorf("failed to process order: %w", err)
+			results[i].Rejected = true
+			continue
+		}
+
+		future, err := s.publishEventAsync(event)
+		if err != nil {
+			results[i].Error = fmt.Errorf("failed to process order: %w", err)
+			continue
+		}
+		inFlight = append(inFlight, pendingPublish{index: i, future: future})
+		if len(inFlight) >= s.config.MaxInFlight {
+			await(inFlight[0])
+			inFlight = inFlight[1:]
+		}
+	}
+	for _, p := range inFlight {
+		await(p)
+	}
+
+	// A failure from here on rolls back the batch. The events that were
+	// published are then published again on the next run, and deduplicated
+	// by JetStream.
+	processedAt := time.Now().Unix()
+	if len(skipped) > 0 {
+		events, err := markOrdersAsSkipped(ctx, tx, skipped, processedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to mark order events as skipped: %w", err)
+		}
+		assert.AlwaysOrUnreachable(len(events) == len(skipped), "Every skipped event must be marked", Details{"marked": len(events), "skipped": len(skipped)})
+		for _, event := range events {
+			assert.AlwaysOrUnreachable(event.Status == OutboxStatusSkipped, "Must have skipped status", nil)
+		}
+	}
+	if len(published) > 0 {
+		events, err := markOrdersAsProcessed(ctx, tx, published, processedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to mark order events as processed: %w", err)
+		}
+		assert.AlwaysOrUnreachable(len(events) == len(published), "Every published event must be marked", Details{"marked": len(events), "published": len(published)})
+		for _, event := range events {
+			assert.AlwaysOrUnreachable(event.ProcessedAt != nil && *event.ProcessedAt == processedAt, "ProcessedAt must not be nil", nil)
+			assert.AlwaysOrUnreachable(event.Status == OutboxStatusSucceeded, "Must have success status", nil)
+		}
+	}
+	for i, result := range results {
+		if result.Error == nil {
+			continue
+		}
+		if result.Rejected {
+			log.Printf("Rejecting order event %v: %v\n", result.OrderOutbox.ID, result.Error)
+			if _, err := markOrderAsFailed(ctx, tx, result.OrderOutbox.ID, result.Error); err != nil {
+				results[i].Error = fmt.Errorf("failed to reject order event %v: %w", result.OrderOutbox.ID, err)
+			}
+			continue
+		}
+		if _, err := s.markOrderForRetry(ctx, tx, result.OrderOutbox, result.Error); err != nil {
+			results[i].Error = fmt.Errorf("failed to record attempt of order event %v: %w", result.OrderOutbox.ID, err)
+		}
 	}
 
 	return results, nil
 }
 
-func (s *OrderService) processEvent(ctx context.Context, tx *sql.Tx, event OrderEvent) ProcessResult {
-	log.Printf("Processing order event %v...", event.ID)
-	result := ProcessResult{OrderOutbox: event}
-	processedAt := time.Now().Unix()
+// publishEventAsync publishes event as a structured-mode CloudEvent, with its
+// outbox ID as the message ID. If the relay crashes between publishing and
+// committing, the event is published again, and JetStream drops the copy as
+// long as it arrives within the stream's duplicate window.
+func (s *OrderService) publishEventAsync(event OrderEvent) (jetstream.PubAckFuture, error) {
+	if event.Subject == "" {
+		return nil, fmt.Errorf("no route for %s event %s", event.AggregateType, event.EventType)
+	}
+	data, err := json.Marshal(newOrderCloudEvent(event))
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal cloud event: %w", err)
+	}
+	msg := &nats.Msg{
+		Subject: event.Subject,
+		Header:  nats.Header{ContentTypeHeader: []string{CloudEventsContentType}},
+		Data:    data,
+	}
+	future, err := s.js.PublishMsgAsync(msg, jetstream.WithMsgID(event.ID.String()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to publish message: %w", err)
+	}
+	return future, nil
+}
 
-	if err := s.publishEvent(ctx, event); err != nil {
-		result.Error = fmt.Errorf("failed to process order: %w", err)
-		return result
+func (s *OrderService) awaitPublish(ctx context.Context, event OrderEvent, future jetstream.PubAckFuture) error {
+	select {
+	case pubAck := <-future.Ok():
+		assert.Sometimes(pubAck.Duplicate, "Sometimes an order event is published more than once", Details{"event_id": event.ID})
+		if pubAck.Duplicate {
+			// The stream already holds this event, which is all we wanted.
+			log.Printf("Order event %v was already published: %v\n", event.ID, pubAck)
+		}
+		return nil
+	case err := <-future.Err():
+		return fmt.Errorf("failed to publish message: %w", err)
+	case <-time.After(publishAckTimeout):
+		return fmt.Errorf("timed out waiting for publish ack of order event %v", event.ID)
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
+
+// markOrderForRetry records a failed publish. The event is retried after an
+// exponential backoff, or marked failed once it used up MaxAttempts.
+func (s *OrderService) markOrderForRetry(ctx context.Context, tx *sql.Tx, event OrderEvent, cause error) (OrderEvent, error) {
+	attempts := event.Attempts + 1
+	now := time.Now()
 
-	// TODO: don't separtae the network calls and just include the statement in a single batch query.
-	ordersEvent, err := markOrderAsProcessed(ctx, tx, event.ID, processedAt)
+	if attempts >= s.config.MaxAttempts {
+		log.Printf("Giving up on order event %v after %d attempts: %v\n", event.ID, attempts, cause)
+		failed, err := markOrderAsFailed(ctx, tx, event.ID, cause)
+		if err != nil {
+			return failed, err
+		}
+		assert.AlwaysOrUnreachable(failed.Status == OutboxStatusFailed, "Must have failed status", nil)
+		assert.AlwaysOrUnreachable(failed.Attempts == s.config.MaxAttempts, "Events must be failed after exactly max attempts", Details{
+			"event_id":     event.ID,
+			"attempts":     failed.Attempts,
+			"max_attempts": s.config.MaxAttempts,
+		})
+		return failed, nil
+	}
+
+	backoff := s.config.RetryBackoff << (attempts - 1)
+	if backoff <= 0 || backoff > s.config.MaxRetryBackoff {
+		backoff = s.config.MaxRetryBackoff
+	}
+	retry, err := scanOrderEvent(tx.QueryRowContext(ctx, markOrderForRetryQuery, cause.Error(), now.Add(backoff).Unix(), event.ID))
 	if err != nil {
-		result.Error = fmt.Errorf("failed to mark order %d as processed: %w", event.ID, err)
-		return result
+		return retry, err
 	}
+	assert.AlwaysOrUnreachable(retry.Status == OutboxStatusPending, "Events being retried must stay pending", nil)
+	assert.Sometimes(retry.Attempts > 1, "Sometimes an order event is retried more than once", Details{"event_id": event.ID, "attempts": retry.Attempts})
+	return retry, nil
+}
 
-	assert.AlwaysOrUnreachable(ordersEvent.ProcessedAt != nil && *ordersEvent.ProcessedAt == processedAt, "ProcessedAt must not be nil", nil)
-	assert.AlwaysOrUnreachable(ordersEvent.Status == OutboxStatusSucceeded, "Must have success status", nil)
-	return result
+func markOrderAsFailed(ctx context.Context, tx *sql.Tx, eventID uuid.UUID, cause error) (OrderEvent, error) {
+	return scanOrderEvent(tx.QueryRowContext(ctx, markOrderAsFailedQuery, cause.Error(), time.Now().Unix(), eventID))
 }
 
-func (s *OrderService) publishEvent(ctx context.Context, event OrderEvent) error { // TODO: replace with NATs.
-	pubAck, err := s.js.Publish(ctx, "ORDERS.new", event.EventPayload) // TODO: event.AggregateType
+func markOrdersAsProcessed(ctx context.Context, tx *sql.Tx, eventIDs []uuid.UUID, processedAt int64) ([]OrderEvent, error) {
+	return queryOrderEvents(ctx, tx, markOrderAsProcessedQuery, processedAt, eventIDArray(eventIDs))
+}
+
+func markOrdersAsSkipped(ctx context.Context, tx *sql.Tx, eventIDs []uuid.UUID, processedAt int64) ([]OrderEvent, error) {
+	return queryOrderEvents(ctx, tx, markOrderAsSkippedQuery, processedAt, eventIDArray(eventIDs))
+}
+
+func queryOrderEvents(ctx context.Context, tx *sql.Tx, query string, args ...any) ([]OrderEvent, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
 	if err != nil {
-		log.Printf("%+v\n", pubAck)
-		return fmt.Errorf("failed to publish message: %w", err)
+		return nil, err
 	}
-	log.Printf("Got publish ack: %v\n", pubAck)
-	return nil
+	defer rows.Close()
+
+	var events []OrderEvent
+	for rows.Next() {
+		event, err := scanOrderEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func eventIDArray(eventIDs []uuid.UUID) any {
+	ids := make([]string, len(eventIDs))
+	for i, id := range eventIDs {
+		ids[i] = id.String()
+	}
+	return pq.Array(ids)
 }
 
-func markOrderAsProcessed(ctx context.Context, tx *sql.Tx, evenID uuid.UUID, processedAt int64) (OrderEvent, error) {
+func scanOrderEvent(row rowScanner) (OrderEvent, error) {
 	var event OrderEvent
-	err := tx.QueryRowContext(
-		ctx,
-		markOrderAsProcessedQuery,
-		processedAt,
-		evenID,
-	).Scan(
+	err := row.Scan(
 		&event.ID,
 		&event.AggregateType,
 		&event.AggregateID,
@@ -568,6 +1341,9 @@ func markOrderAsProcessed(ctx context.Context, tx *sql.Tx, evenID uuid.UUID, pro
 		&event.CreatedAt,
 		&event.ProcessedAt,
 		&event.Status,
+		&event.Attempts,
+		&event.LastError,
+		&event.NextAttemptAt,
 	)
 	return event, err
 }
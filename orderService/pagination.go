@@ -0,0 +1,128 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+type (
+	// OrderCursor is the keyset position after which the next page starts.
+	// Clients only ever see it base64-encoded.
+	OrderCursor struct {
+		CreatedAt int64 `json:"created_at"`
+		ID        int64 `json:"id"`
+	}
+
+	ListOrdersFilter struct {
+		Status        *OrderStatus
+		Customer      *string
+		CreatedAfter  *int64
+		CreatedBefore *int64
+		Cursor        *OrderCursor
+		Limit         int
+	}
+
+	ListOrdersResponse struct {
+		Orders     []Order `json:"orders"`
+		NextCursor string  `json:"next_cursor,omitempty"`
+	}
+)
+
+func (c OrderCursor) Encode() string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeOrderCursor(encoded string) (*OrderCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	var cursor OrderCursor
+	if err := json.Unmarshal(raw, &cursor); err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &cursor, nil
+}
+
+func parseListOrdersFilter(query url.Values) (ListOrdersFilter, error) {
+	filter := ListOrdersFilter{Limit: defaultListLimit}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxListLimit {
+			return filter, fmt.Errorf("limit must be between 1 and %d: got %v", maxListLimit, v)
+		}
+		filter.Limit = limit
+	}
+	if v := query.Get("cursor"); v != "" {
+		cursor, err := decodeOrderCursor(v)
+		if err != nil {
+			return filter, err
+		}
+		filter.Cursor = cursor
+	}
+	if v := query.Get("status"); v != "" {
+		status := OrderStatus(v)
+		if !status.Valid() {
+			return filter, fmt.Errorf("unknown order status: %v", v)
+		}
+		filter.Status = &status
+	}
+	if v := query.Get("customer"); v != "" {
+		filter.Customer = &v
+	}
+	for param, dst := range map[string]**int64{
+		"created_after":  &filter.CreatedAfter,
+		"created_before": &filter.CreatedBefore,
+	} {
+		v := query.Get(param)
+		if v == "" {
+			continue
+		}
+		ts, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return filter, fmt.Errorf("%s must be a unix timestamp: got %v", param, v)
+		}
+		*dst = &ts
+	}
+
+	return filter, nil
+}
+
+// args returns the positional parameters of order_list.sql. One extra row is
+// requested so the handler can tell whether another page exists.
+func (f ListOrdersFilter) args() []any {
+	var (
+		status             sql.NullString
+		customer           sql.NullString
+		after, before      sql.NullInt64
+		cursorAt, cursorID sql.NullInt64
+	)
+	if f.Status != nil {
+		status = sql.NullString{String: string(*f.Status), Valid: true}
+	}
+	if f.Customer != nil {
+		customer = sql.NullString{String: *f.Customer, Valid: true}
+	}
+	if f.CreatedAfter != nil {
+		after = sql.NullInt64{Int64: *f.CreatedAfter, Valid: true}
+	}
+	if f.CreatedBefore != nil {
+		before = sql.NullInt64{Int64: *f.CreatedBefore, Valid: true}
+	}
+	if f.Cursor != nil {
+		cursorAt = sql.NullInt64{Int64: f.Cursor.CreatedAt, Valid: true}
+		cursorID = sql.NullInt64{Int64: f.Cursor.ID, Valid: true}
+	}
+	return []any{status, customer, after, before, cursorAt, cursorID, f.Limit + 1}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/antithesishq/antithesis-sdk-go/assert"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	EventTypePaymentSucceeded = "PAYMENT_SUCCEEDED"
+	EventTypePaymentFailed    = "PAYMENT_FAILED"
+	EventTypeRefundSucceeded  = "REFUND_SUCCEEDED"
+	EventTypeRefundFailed     = "REFUND_FAILED"
+
+	paymentsConsumer = "ORDER_SERVICE"
+
+	// cancelledChargeRefundReason is the reason of the refunds of orders
+	// charged after they were cancelled.
+	cancelledChargeRefundReason = "order_cancelled"
+)
+
+var (
+	//go:embed db/ops/order_status_update.sql
+	updateOrderStatusQuery string
+)
+
+type (
+	// PaymentOutcomePayload is published by the payment service on PAYMENTS
+	// once Stripe has charged an order or declined to.
+	PaymentOutcomePayload struct {
+		OrderID       int64  `json:"order_id"`
+		ChargeID      string `json:"charge_id,omitempty"`
+		FailureReason string `json:"failure_reason,omitempty"`
+	}
+
+	// RefundOutcomePayload is published by the payment service on PAYMENTS
+	// once Stripe has accepted or rejected a refund.
+	RefundOutcomePayload struct {
+		RefundID       uuid.UUID `json:"refund_id"`
+		OrderID        int64     `json:"order_id"`
+		StripeRefundID string    `json:"stripe_refund_id,omitempty"`
+		FailureReason  string    `json:"failure_reason,omitempty"`
+	}
+)
+
+// consumePaymentEvents applies the payment service's outcomes to orders until
+// the service is stopped. Messages are only acked once their effect is
+// committed, so a crash redelivers them.
+func (s *OrderService) consumePaymentEvents(ctx context.Context, consumer jetstream.Consumer) {
+	assert.Always(s.started, "Service must be started before consuming payment events", Details{"op": "consume_payment_events"})
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.done:
+			return
+		default:
+		}
+
+		msgs, err := consumer.Fetch(100, jetstream.FetchMaxWait(5*time.Second))
+		if err != nil {
+			log.Printf("Error fetching payment events: %v\n", err)
+			time.Sleep(1 * time.Second) // Back off on error
+			continue
+		}
+
+		for msg := range msgs.Messages() {
+			if err := s.handlePaymentEvent(ctx, msg); err != nil {
+				log.Printf("Error handling payment event: %v\n", err)
+				msg.NakWithDelay(time.Second)
+				continue
+			}
+			msg.Ack()
+		}
+		if err := msgs.Error(); err != nil && !errors.Is(err, context.Canceled) {
+			log.Printf("Error fetching payment events: %v\n", err)
+		}
+	}
+}
+
+func (s *OrderService) handlePaymentEvent(ctx context.Context, msg jetstream.Msg) error {
+	event, err := parseCloudEvent(msg.Data())
+	if err != nil {
+		// Redelivering a malformed message cannot fix it.
+		log.Printf("Dropping malformed payment event: %v\n", err)
+		return nil
+	}
+
+	switch event.Type {
+	case EventTypePaymentSucceeded, EventTypePaymentFailed:
+		var payload PaymentOutcomePayload
+		if err := json.Unmarshal(event.Data, &payload); err != nil {
+			log.Printf("Dropping malformed %s event %s: %v\n", event.Type, event.ID, err)
+			return nil
+		}
+
+		status := OrderStatusSucceeded
+		if event.Type == EventTypePaymentFailed {
+			status = OrderStatusFailed
+		}
+		changed, err := s.settlePayment(ctx, payload.OrderID, status, sql.NullString{String: payload.ChargeID, Valid: payload.ChargeID != ""})
+		if err != nil {
+			return fmt.Errorf("failed to settle payment of order %d: %w", payload.OrderID, err)
+		}
+		if changed {
+			s.statuses.Publish(payload.OrderID)
+		}
+		return nil
+	case EventTypeRefundSucceeded, EventTypeRefundFailed:
+		var payload RefundOutcomePayload
+		if err := json.Unmarshal(event.Data, &payload); err != nil {
+			log.Printf("Dropping malformed %s event %s: %v\n", event.Type, event.ID, err)
+			return nil
+		}
+
+		status := RefundStatusSucceeded
+		if event.Type == EventTypeRefundFailed {
+			status = RefundStatusFailed
+		}
+		changed, err := s.settleRefund(
+			ctx,
+			payload.RefundID,
+			status,
+			sql.NullString{String: payload.StripeRefundID, Valid: payload.StripeRefundID != ""},
+			sql.NullString{String: payload.FailureReason, Valid: payload.FailureReason != ""},
+		)
+		if err != nil {
+			return fmt.Errorf("failed to settle refund %v: %w", payload.RefundID, err)
+		}
+		if changed {
+			s.statuses.Publish(payload.OrderID)
+		}
+		return nil
+	default:
+		log.Printf("Ignoring payment event of type %q\n", event.Type)
+		return nil
+	}
+}
+
+// settlePayment moves a pending order to the status the payment outcome
+// implies. Outcomes may be delivered more than once or arrive after the order
+// moved on, so outcomes the state machine does not allow are ignored. The
+// exception is a charge of an order cancelled while it was being charged,
+// which is recorded and refunded in full. It reports whether the order
+// changed.
+func (s *OrderService) settlePayment(ctx context.Context, orderID int64, status OrderStatus, chargeID sql.NullString) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	order, err := scanOrder(tx.QueryRowContext(ctx, getOrderForUpdateQuery, orderID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// The order was charged before this service restarted and reset
+			// its tables, so there is no order left to settle or to refund
+			// a late charge of.
+			log.Printf("Ignoring payment outcome of unknown order %d\n", orderID)
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to get order %d: %w", orderID, err)
+	}
+
+	if status == OrderStatusSucceeded && order.Status == OrderStatusCancelled {
+		if order.ChargeID != nil {
+			// The charge is already being refunded.
+			return false, nil
+		}
+		if err := s.refundCancelledCharge(ctx, tx, order, chargeID); err != nil {
+			return false, err
+		}
+		if err := tx.Commit(); err != nil {
+			return false, fmt.Errorf("failed to commit transaction: %w", err)
+		}
+		return true, nil
+	}
+
+	assert.Sometimes(order.Status == status, "Sometimes a payment outcome is delivered more than once", Details{"order_id": orderID})
+	if order.Status == status {
+		return false, nil
+	}
+	if err := order.Status.Transition(status); err != nil {
+		assert.Reachable("A stale payment outcome is ignored", Details{"order_id": orderID, "status": order.Status, "outcome": status})
+		log.Printf("Ignoring stale payment outcome of order %d: %v\n", orderID, err)
+		return false, nil
+	}
+
+	updated, err := scanOrder(tx.QueryRowContext(ctx, updateOrderStatusQuery, orderID, status, time.Now().Unix(), chargeID))
+	if err != nil {
+		return false, fmt.Errorf("failed to update order %d: %w", orderID, err)
+	}
+	assert.AlwaysOrUnreachable(updated.Status == status, "Settled orders must have the outcome's status", Details{"order_id": orderID, "status": updated.Status})
+	assert.AlwaysOrUnreachable(updated.Version == order.Version+1, "Settling an order must bump its version", Details{"before": order.Version, "after": updated.Version})
+	assert.AlwaysOrUnreachable(updated.UpdatedAt != nil, "Settled orders must have an updated_at", Details{"order_id": orderID})
+	assert.AlwaysOrUnreachable(status != OrderStatusSucceeded || updated.ChargeID != nil, "Succeeded orders must have a charge", Details{"order_id": orderID})
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return true, nil
+}
+
+// refundCancelledCharge records the charge of a cancelled order and requests
+// a refund of all of it. The relay does not lock orders, so an order can be
+// cancelled after its ORDER_CREATED event was published and charged.
+func (s *OrderService) refundCancelledCharge(ctx context.Context, tx *sql.Tx, order Order, chargeID sql.NullString) error {
+	assert.AlwaysOrUnreachable(chargeID.Valid, "Succeeded payments must have a charge", Details{"order_id": order.ID})
+	if !chargeID.Valid {
+		return fmt.Errorf("payment of order %d succeeded without a charge", order.ID)
+	}
+	log.Printf("Order %d was charged after it was cancelled, refunding charge %s\n", order.ID, chargeID.String)
+
+	now := time.Now().Unix()
+	updated, err := scanOrder(tx.QueryRowContext(ctx, updateOrderStatusQuery, order.ID, OrderStatusCancelled, now, chargeID))
+	if err != nil {
+		return fmt.Errorf("failed to record charge of order %d: %w", order.ID, err)
+	}
+	assert.AlwaysOrUnreachable(updated.Status == OrderStatusCancelled, "Recording a charge must not change the order status", Details{"order_id": order.ID, "status": updated.Status})
+	assert.AlwaysOrUnreachable(updated.Version == order.Version+1, "Recording a charge must bump the order version", Details{"before": order.Version, "after": updated.Version})
+
+	refund, event, err := scanRefundQueryResult(tx.QueryRowContext(
+		ctx,
+		createRefundQuery,
+		order.ID,
+		order.Amount-order.RefundedAmount,
+		order.Currency,
+		cancelledChargeRefundReason,
+		now,
+		chargeID.String,
+	))
+	if err != nil {
+		return fmt.Errorf("failed to refund charge of order %d: %w", order.ID, err)
+	}
+	assert.AlwaysOrUnreachable(refund.Amount == order.Amount, "Charges of cancelled orders must be refunded in full", Details{"order_id": order.ID, "amount": order.Amount, "refund": refund.Amount})
+	assert.AlwaysOrUnreachable(event.EventType == EventTypeOrderRefundRequested, "Refund events must have ORDER_REFUND_REQUESTED event type", nil)
+	return nil
+}
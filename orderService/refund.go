@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/antithesishq/antithesis-sdk-go/assert"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	RefundStatusPending   RefundStatus = "pending"
+	RefundStatusSucceeded RefundStatus = "succeeded"
+	RefundStatusFailed    RefundStatus = "failed"
+)
+
+var (
+	//go:embed db/ops/order_refund_create.sql
+	createRefundQuery string
+
+	//go:embed db/ops/order_refund_list.sql
+	listRefundsQuery string
+
+	//go:embed db/ops/order_refund_get_for_update.sql
+	getRefundForUpdateQuery string
+
+	//go:embed db/ops/order_refund_pending_total.sql
+	pendingRefundTotalQuery string
+
+	//go:embed db/ops/order_refund_settle.sql
+	settleRefundQuery string
+
+	//go:embed db/ops/order_refunded.sql
+	refundOrderQuery string
+)
+
+type (
+	RefundStatus string
+
+	Refund struct {
+		ID             uuid.UUID    `json:"id" db:"id"`
+		OrderID        int64        `json:"order_id" db:"order_id"`
+		Amount         MinorUnits   `json:"amount" db:"amount"`
+		Currency       string       `json:"currency" db:"currency"`
+		Reason         string       `json:"reason" db:"reason"`
+		Status         RefundStatus `json:"status" db:"status"`
+		StripeRefundID *string      `json:"stripe_refund_id,omitempty" db:"stripe_refund_id"`
+		FailureReason  *string      `json:"failure_reason,omitempty" db:"failure_reason"`
+		CreatedAt      int64        `json:"created_at" db:"created_at"`
+		UpdatedAt      *int64       `json:"updated_at,omitempty" db:"updated_at"`
+	}
+
+	// CreateRefundRequest refunds Amount of the order, or everything still
+	// refundable when Amount is omitted.
+	CreateRefundRequest struct {
+		Amount MinorUnits `json:"amount,omitempty"`
+		Reason string     `json:"reason,omitempty"`
+	}
+
+	ListRefundsResponse struct {
+		Refunds []Refund `json:"refunds"`
+	}
+
+	// RefundRequestedPayload is the event_payload of ORDER_REFUND_REQUESTED
+	// outbox events.
+	RefundRequestedPayload struct {
+		RefundID uuid.UUID  `json:"refund_id"`
+		OrderID  int64      `json:"order_id"`
+		ChargeID string     `json:"charge_id"`
+		Amount   MinorUnits `json:"amount"`
+		Currency string     `json:"currency"`
+		Reason   string     `json:"reason"`
+	}
+)
+
+// CreateRefund records a pending refund and its ORDER_REFUND_REQUESTED event.
+// Only succeeded orders with a charge can be refunded, and the amount is
+// bounded by what was charged minus what is already refunded or pending.
+func (s *OrderService) CreateRefund(w http.ResponseWriter, r *http.Request) {
+	assert.Always(s.started, "Service must be started before handling requests", Details{"op": "create_refund"})
+
+	orderID, err := strconv.ParseInt(chi.URLParam(r, "orderID"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	var req CreateRefundRequest
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Amount < 0 {
+		http.Error(w, fmt.Sprintf("Refund amount must be positive: got %v", req.Amount), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := s.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Failed to begin transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the order so concurrent refunds see each other's pending amounts.
+	order, err := scanOrder(tx.QueryRowContext(r.Context(), getOrderForUpdateQuery, orderID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to get order: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := order.Status.Transition(OrderStatusRefunded); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if order.ChargeID == nil {
+		http.Error(w, "Order has no charge to refund", http.StatusConflict)
+		return
+	}
+
+	var pending MinorUnits
+	if err := tx.QueryRowContext(r.Context(), pendingRefundTotalQuery, orderID).Scan(&pending); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get pending refunds: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	refundable := order.Amount - order.RefundedAmount - pending
+	assert.AlwaysOrUnreachable(refundable >= 0, "Refunds must never exceed the charged amount", Details{
+		"order_id": orderID,
+		"amount":   order.Amount,
+		"refunded": order.RefundedAmount,
+		"pending":  pending,
+	})
+
+	amount := req.Amount
+	if amount == 0 {
+		amount = refundable
+	}
+	assert.Sometimes(amount < refundable, "Sometimes an order is partially refunded", Details{"amount": amount, "refundable": refundable})
+	if amount <= 0 || amount > refundable {
+		http.Error(w, fmt.Sprintf("Refund amount must be between 1 and %d: got %d", refundable, amount), http.StatusUnprocessableEntity)
+		return
+	}
+
+	row := tx.QueryRowContext(
+		r.Context(),
+		createRefundQuery,
+		orderID,
+		amount,
+		order.Currency,
+		req.Reason,
+		time.Now().Unix(),
+		*order.ChargeID,
+	)
+	refund, event, err := scanRefundQueryResult(row)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create refund: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	assert.AlwaysOrUnreachable(refund.Status == RefundStatusPending, "New refunds must have a pending status", Details{"status": refund.Status})
+	assert.AlwaysOrUnreachable(event.AggregateType == AggregateTypeOrder, "Event must go to the order topic", Details{"aggregate_type": event.AggregateType})
+	assert.AlwaysOrUnreachable(event.AggregateID == orderID, "AggregateID must map to orderID", nil)
+	assert.AlwaysOrUnreachable(event.EventType == EventTypeOrderRefundRequested, "Refund events must have ORDER_REFUND_REQUESTED event type", nil)
+
+	expectedPayload := RefundRequestedPayload{
+		RefundID: refund.ID,
+		OrderID:  orderID,
+		ChargeID: *order.ChargeID,
+		Amount:   amount,
+		Currency: order.Currency,
+		Reason:   req.Reason,
+	}
+	var actualPayload RefundRequestedPayload
+	err = json.Unmarshal(event.EventPayload, &actualPayload)
+	assert.AlwaysOrUnreachable(err == nil, "Must be able to unmarshal refund event payload", Details{"error": err})
+	assert.AlwaysOrUnreachable(actualPayload == expectedPayload, "Refund event payload must match expected payload", Details{
+		"expected": expectedPayload,
+		"actual":   actualPayload,
+	})
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, "Failed to commit transaction", http.StatusInternalServerError)
+		return
+	}
+
+	writeRefund(w, http.StatusAccepted, refund)
+}
+
+func (s *OrderService) ListRefunds(w http.ResponseWriter, r *http.Request) {
+	assert.Always(s.started, "Service must be started before handling requests", Details{"op": "list_refunds"})
+
+	orderID, err := strconv.ParseInt(chi.URLParam(r, "orderID"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := s.db.QueryContext(r.Context(), listRefundsQuery, orderID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list refunds: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	refunds := []Refund{}
+	for rows.Next() {
+		refund, err := scanRefund(rows)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to scan refund: %v", err), http.StatusInternalServerError)
+			return
+		}
+		refunds = append(refunds, refund)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list refunds: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	out, err := json.Marshal(ListRefundsResponse{Refunds: refunds})
+	if err != nil {
+		http.Error(w, "Failed to serialize response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+}
+
+// settleRefund applies the payment service's outcome to a pending refund. The
+// outcome may be delivered more than once, so refunds that are no longer
+// pending are left alone. A succeeded refund adds to the order's refunded
+// amount and moves the order to refunded once it is fully refunded. It reports
+// whether the order changed.
+func (s *OrderService) settleRefund(ctx context.Context, refundID uuid.UUID, status RefundStatus, stripeRefundID, failureReason sql.NullString) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	refund, err := scanRefund(tx.QueryRowContext(ctx, getRefundForUpdateQuery, refundID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// Nothing to apply the outcome to, e.g. after the schema was reset.
+			log.Printf("Ignoring outcome of unknown refund %v\n", refundID)
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to get refund %v: %w", refundID, err)
+	}
+
+	assert.Sometimes(refund.Status != RefundStatusPending, "Sometimes a refund outcome is delivered more than once", Details{"refund_id": refundID})
+	if refund.Status != RefundStatusPending {
+		return false, nil
+	}
+
+	now := time.Now().Unix()
+	refund, err = scanRefund(tx.QueryRowContext(ctx, settleRefundQuery, refundID, status, stripeRefundID, failureReason, now))
+	if err != nil {
+		return false, fmt.Errorf("failed to settle refund %v: %w", refundID, err)
+	}
+	assert.AlwaysOrUnreachable(refund.Status == status, "Settled refunds must have the reported status", Details{"refund_id": refundID, "status": refund.Status})
+
+	orderChanged := false
+	if status == RefundStatusSucceeded {
+		order, err := scanOrder(tx.QueryRowContext(ctx, getOrderForUpdateQuery, refund.OrderID))
+		if err != nil {
+			return false, fmt.Errorf("failed to get order %d: %w", refund.OrderID, err)
+		}
+
+		next := order.Status
+		if order.RefundedAmount+refund.Amount == order.Amount {
+			if err := order.Status.Transition(OrderStatusRefunded); err != nil {
+				return false, err
+			}
+			next = OrderStatusRefunded
+		}
+
+		updated, err := scanOrder(tx.QueryRowContext(ctx, refundOrderQuery, order.ID, refund.Amount, next, now))
+		if err != nil {
+			return false, fmt.Errorf("failed to refund order %d: %w", order.ID, err)
+		}
+		assert.AlwaysOrUnreachable(updated.RefundedAmount <= updated.Amount, "Refunded amount must never exceed the order amount", Details{
+			"order_id": updated.ID,
+			"amount":   updated.Amount,
+			"refunded": updated.RefundedAmount,
+		})
+		assert.AlwaysOrUnreachable(updated.Version == order.Version+1, "Refunding an order must bump its version", Details{"before": order.Version, "after": updated.Version})
+		orderChanged = true
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return orderChanged, nil
+}
+
+func scanRefund(row rowScanner) (Refund, error) {
+	var refund Refund
+	err := row.Scan(
+		&refund.ID,
+		&refund.OrderID,
+		&refund.Amount,
+		&refund.Currency,
+		&refund.Reason,
+		&refund.Status,
+		&refund.StripeRefundID,
+		&refund.FailureReason,
+		&refund.CreatedAt,
+		&refund.UpdatedAt,
+	)
+	return refund, err
+}
+
+func scanRefundQueryResult(row rowScanner) (Refund, OrderEvent, error) {
+	var (
+		refund Refund
+		event  OrderEvent
+	)
+	err := row.Scan(
+		&refund.ID,
+		&refund.OrderID,
+		&refund.Amount,
+		&refund.Currency,
+		&refund.Reason,
+		&refund.Status,
+		&refund.StripeRefundID,
+		&refund.FailureReason,
+		&refund.CreatedAt,
+		&refund.UpdatedAt,
+		&event.ID,
+		&event.AggregateType,
+		&event.AggregateID,
+		&event.EventType,
+		&event.EventPayload,
+		&event.CreatedAt,
+		&event.ProcessedAt,
+		&event.Status,
+	)
+	return refund, event, err
+}
+
+func writeRefund(w http.ResponseWriter, status int, refund Refund) {
+	out, err := json.Marshal(refund)
+	if err != nil {
+		http.Error(w, "Failed to serialize response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(out)
+}
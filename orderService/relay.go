@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	_ "embed"
+	"log"
+
+	"github.com/antithesishq/antithesis-sdk-go/assert"
+)
+
+const (
+	// RelayModeConcurrent lets every replica relay at once. Replicas never
+	// publish the same event twice, but may publish the events of one order
+	// out of order.
+	RelayModeConcurrent RelayMode = "concurrent"
+
+	// RelayModeLeader lets only the replica holding the relay advisory lock
+	// relay. The lock is tied to a dedicated connection, so it passes to
+	// another replica as soon as the leader's connection drops. Like
+	// RelayModePerAggregate, only the oldest pending event of an order is
+	// eligible, as a single relay still reorders an order's events when they
+	// share a created_at second or an earlier one is backing off.
+	RelayModeLeader RelayMode = "leader"
+
+	// RelayModePerAggregate lets every replica relay at once, but only the
+	// oldest pending event of an order is ever eligible, so the events of
+	// one order are published in the order they were written.
+	RelayModePerAggregate RelayMode = "per_aggregate"
+
+	// outboxRelayLockKey identifies the relay advisory lock ("outbox").
+	outboxRelayLockKey int64 = 0x6f7574626f78
+)
+
+var (
+	//go:embed db/ops/order_process_heads.sql
+	getUnprocessedOrderHeadsQuery string
+
+	//go:embed db/ops/outbox_relay_lock.sql
+	tryRelayLockQuery string
+)
+
+type (
+	RelayMode string
+
+	// relayLeadership holds the relay advisory lock on its own connection.
+	// Postgres releases the lock when that connection closes, whichever side
+	// closes it.
+	relayLeadership struct {
+		db   *sql.DB
+		conn *sql.Conn
+	}
+)
+
+// Valid reports whether m is a known relay mode.
+func (m RelayMode) Valid() bool {
+	switch m {
+	case RelayModeConcurrent, RelayModeLeader, RelayModePerAggregate:
+		return true
+	}
+	return false
+}
+
+// dequeueQuery is the statement the relay selects pending events with.
+func (m RelayMode) dequeueQuery() string {
+	if m == RelayModePerAggregate || m == RelayModeLeader {
+		return getUnprocessedOrderHeadsQuery
+	}
+	return getUnprocessedOrdersQuery
+}
+
+// acquire reports whether this replica is the relay leader, trying to become
+// it when it is not. A leader whose connection broke steps down, and may win
+// the lock again on a later call.
+func (l *relayLeadership) acquire(ctx context.Context) bool {
+	if l.conn != nil {
+		if err := l.conn.PingContext(ctx); err == nil {
+			return true
+		}
+		log.Printf("Lost the outbox relay lock: connection is broken\n")
+		l.release()
+	}
+
+	conn, err := l.db.Conn(ctx)
+	if err != nil {
+		log.Printf("Failed to get a connection for the outbox relay lock: %v\n", err)
+		return false
+	}
+	var acquired bool
+	if err := conn.QueryRowContext(ctx, tryRelayLockQuery, outboxRelayLockKey).Scan(&acquired); err != nil || !acquired {
+		if err != nil {
+			log.Printf("Failed to try the outbox relay lock: %v\n", err)
+		}
+		conn.Close()
+		return false
+	}
+
+	assert.Reachable("A replica becomes the outbox relay leader", nil)
+	log.Printf("Acquired the outbox relay lock\n")
+	l.conn = conn
+	return true
+}
+
+func (l *relayLeadership) release() {
+	if l.conn == nil {
+		return
+	}
+	// Discard the connection rather than unlocking: a plain Close would hand
+	// it back to the pool with the lock still held, and unlocking fails on a
+	// broken connection anyway.
+	l.conn.Raw(func(driverConn any) error { return driver.ErrBadConn })
+	l.conn.Close()
+	l.conn = nil
+}
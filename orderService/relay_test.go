@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/guergabo/demo/order-service/eventschema"
+	"github.com/lib/pq"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// fakeOutbox is an in-memory database/sql driver holding order_outboxes. It
+// understands the statements processEvents marks events with.
+type fakeOutbox struct {
+	mu     sync.Mutex
+	events map[string]*OrderEvent
+}
+
+func newFakeOutbox(t *testing.T, events []OrderEvent) (*fakeOutbox, *sql.DB) {
+	t.Helper()
+
+	fake := &fakeOutbox{events: make(map[string]*OrderEvent)}
+	for _, event := range events {
+		fake.events[event.ID.String()] = &event
+	}
+	db := sql.OpenDB(fake)
+	t.Cleanup(func() { db.Close() })
+	return fake, db
+}
+
+func (f *fakeOutbox) Connect(context.Context) (driver.Conn, error) { return f, nil }
+func (f *fakeOutbox) Driver() driver.Driver                        { return f }
+func (f *fakeOutbox) Open(string) (driver.Conn, error)             { return f, nil }
+
+func (f *fakeOutbox) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("fakeOutbox: prepared statements are not supported")
+}
+
+func (f *fakeOutbox) Close() error              { return nil }
+func (f *fakeOutbox) Begin() (driver.Tx, error) { return f, nil }
+func (f *fakeOutbox) Commit() error             { return nil }
+func (f *fakeOutbox) Rollback() error           { return nil }
+
+func (f *fakeOutbox) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var updated []*OrderEvent
+	update := func(id driver.Value, apply func(event *OrderEvent)) error {
+		event, ok := f.events[fmt.Sprint(id)]
+		if !ok {
+			return fmt.Errorf("fakeOutbox: no event %v", id)
+		}
+		apply(event)
+		updated = append(updated, event)
+		return nil
+	}
+	updateAll := func(ids driver.Value, apply func(event *OrderEvent)) error {
+		var array pq.StringArray
+		if err := array.Scan(ids); err != nil {
+			return err
+		}
+		for _, id := range array {
+			if err := update(id, apply); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var err error
+	switch query {
+	case markOrderAsProcessedQuery, markOrderAsSkippedQuery:
+		status := OutboxStatusSucceeded
+		if query == markOrderAsSkippedQuery {
+			status = OutboxStatusSkipped
+		}
+		processedAt := args[0].Value.(int64)
+		err = updateAll(args[1].Value, func(event *OrderEvent) {
+			event.ProcessedAt = &processedAt
+			event.Status = status
+		})
+	case markOrderForRetryQuery:
+		lastError, nextAttemptAt := args[0].Value.(string), args[1].Value.(int64)
+		err = update(args[2].Value, func(event *OrderEvent) {
+			event.Attempts++
+			event.LastError = &lastError
+			event.NextAttemptAt = nextAttemptAt
+		})
+	case markOrderAsFailedQuery:
+		lastError, processedAt := args[0].Value.(string), args[1].Value.(int64)
+		err = update(args[2].Value, func(event *OrderEvent) {
+			event.Attempts++
+			event.LastError = &lastError
+			event.ProcessedAt = &processedAt
+			event.Status = OutboxStatusFailed
+		})
+	default:
+		return nil, fmt.Errorf("fakeOutbox: unsupported query: %s", query)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows := &fakeOutboxRows{}
+	for _, event := range updated {
+		var processedAt, lastError driver.Value
+		if event.ProcessedAt != nil {
+			processedAt = *event.ProcessedAt
+		}
+		if event.LastError != nil {
+			lastError = *event.LastError
+		}
+		rows.rows = append(rows.rows, []driver.Value{
+			event.ID.String(),
+			event.AggregateType,
+			event.AggregateID,
+			event.EventType,
+			[]byte(event.EventPayload),
+			event.CreatedAt,
+			processedAt,
+			string(event.Status),
+			int64(event.Attempts),
+			lastError,
+			event.NextAttemptAt,
+		})
+	}
+	return rows, nil
+}
+
+// event returns the outbox row of id.
+func (f *fakeOutbox) event(id uuid.UUID) OrderEvent {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return *f.events[id.String()]
+}
+
+type fakeOutboxRows struct {
+	rows [][]driver.Value
+}
+
+func (r *fakeOutboxRows) Columns() []string { return make([]string, 11) }
+func (r *fakeOutboxRows) Close() error      { return nil }
+
+func (r *fakeOutboxRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// fakeJetStream acks every asynchronous publish right away, except those of
+// the events in nacks, and records how many publishes were awaited at most.
+type fakeJetStream struct {
+	jetstream.JetStream
+
+	mu          sync.Mutex
+	nacks       map[string]error
+	published   []string
+	inFlight    int
+	maxInFlight int
+}
+
+func (js *fakeJetStream) PublishMsgAsync(msg *nats.Msg, opts ...jetstream.PublishOpt) (jetstream.PubAckFuture, error) {
+	var event CloudEvent
+	if err := json.Unmarshal(msg.Data, &event); err != nil {
+		return nil, err
+	}
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	js.published = append(js.published, event.ID)
+	js.inFlight++
+	js.maxInFlight = max(js.maxInFlight, js.inFlight)
+
+	future := &fakePubAckFuture{js: js, msg: msg, ok: make(chan *jetstream.PubAck, 1), err: make(chan error, 1)}
+	if err, ok := js.nacks[event.ID]; ok {
+		future.err <- err
+	} else {
+		future.ok <- &jetstream.PubAck{Stream: "ORDERS", Sequence: uint64(len(js.published))}
+	}
+	return future, nil
+}
+
+type fakePubAckFuture struct {
+	js      *fakeJetStream
+	msg     *nats.Msg
+	ok      chan *jetstream.PubAck
+	err     chan error
+	awaited sync.Once
+}
+
+// await marks the publish as no longer in flight once its outcome is read.
+func (f *fakePubAckFuture) await() {
+	f.awaited.Do(func() {
+		f.js.mu.Lock()
+		defer f.js.mu.Unlock()
+		f.js.inFlight--
+	})
+}
+
+func (f *fakePubAckFuture) Ok() <-chan *jetstream.PubAck { f.await(); return f.ok }
+func (f *fakePubAckFuture) Err() <-chan error            { f.await(); return f.err }
+func (f *fakePubAckFuture) Msg() *nats.Msg               { return f.msg }
+
+func TestProcessEventsRetriesOnlyNackedEvents(t *testing.T) {
+	schemas, err := eventschema.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make([]OrderEvent, 5)
+	for i := range events {
+		id := uuid.New()
+		payload := fmt.Sprintf(
+			`{"order_id": %d, "event_id": %q, "created_at": 1700000000, "amount": 1999, "currency": "usd", "currency_exponent": 2, "customer": "cus_123", "description": "order", "items": []}`,
+			i+1, id,
+		)
+		events[i] = OrderEvent{
+			ID:              id,
+			AggregateType:   AggregateTypeOrder,
+			AggregateID:     int64(i + 1),
+			EventType:       EventTypeOrderCreated,
+			EventPayload:    json.RawMessage(payload),
+			SchemaVersion:   2,
+			CreatedAt:       1700000000,
+			Status:          OutboxStatusPending,
+			NextAttemptAt:   1700000000,
+			AggregateStatus: OrderStatusPending,
+			Subject:         "ORDERS.created",
+		}
+	}
+	nacked := events[2]
+
+	outbox, db := newFakeOutbox(t, events)
+	js := &fakeJetStream{nacks: map[string]error{nacked.ID.String(): jetstream.ErrNoStreamResponse}}
+	s := &OrderService{
+		db: db,
+		js: js,
+		config: OrderServiceConfig{
+			MaxAttempts:     defaultOutboxMaxAttempts,
+			RetryBackoff:    defaultOutboxRetryBackoff,
+			MaxRetryBackoff: defaultOutboxMaxRetryBackoff,
+			MaxInFlight:     2,
+			Schemas:         schemas,
+		},
+	}
+
+	tx, err := db.BeginTx(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	start := time.Now().Unix()
+	results, err := s.processEvents(context.Background(), tx, events)
+	if err != nil {
+		t.Fatalf("processEvents: %v", err)
+	}
+
+	if len(js.published) != len(events) {
+		t.Errorf("published %d events, want %d", len(js.published), len(events))
+	}
+	if js.maxInFlight > s.config.MaxInFlight {
+		t.Errorf("had %d publishes in flight, want at most %d", js.maxInFlight, s.config.MaxInFlight)
+	}
+	for i, event := range events {
+		row := outbox.event(event.ID)
+		if event.ID == nacked.ID {
+			if results[i].Error == nil {
+				t.Errorf("event %d: nacked publish has no error", i)
+			}
+			if row.Status != OutboxStatusPending || row.Attempts != 1 || row.LastError == nil || row.NextAttemptAt <= start || row.ProcessedAt != nil {
+				t.Errorf("event %d: nacked event is %+v, want it pending with one attempt and a later retry", i, row)
+			}
+			continue
+		}
+		if results[i].Error != nil {
+			t.Errorf("event %d: %v", i, results[i].Error)
+		}
+		if row.Status != OutboxStatusSucceeded || row.Attempts != 0 || row.LastError != nil || row.ProcessedAt == nil {
+			t.Errorf("event %d: acked event is %+v, want it succeeded without retries", i, row)
+		}
+	}
+}
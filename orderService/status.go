@@ -0,0 +1,93 @@
+package main
+
+import "fmt"
+
+var (
+	orderStatuses = []OrderStatus{
+		OrderStatusPending,
+		OrderStatusSucceeded,
+		OrderStatusFailed,
+		OrderStatusCancelled,
+		OrderStatusRefunded,
+	}
+
+	// orderTransitions is the order state machine: for each status, the
+	// statuses an order may move to next. Terminal statuses have no entry.
+	orderTransitions = map[OrderStatus][]OrderStatus{
+		OrderStatusPending: {
+			OrderStatusSucceeded,
+			OrderStatusFailed,
+			OrderStatusCancelled,
+		},
+		OrderStatusSucceeded: {
+			OrderStatusRefunded,
+		},
+		// A cancelled order is still charged when the payment service
+		// picked it up before the cancellation, and is then refunded.
+		OrderStatusCancelled: {
+			OrderStatusRefunded,
+		},
+	}
+
+	// outboxEventTransitions maps an outbox event type to the transition it
+	// asks downstream consumers to perform on the order. The relay only
+	// publishes such an event while the order can still make that transition.
+	outboxEventTransitions = map[string]OrderStatus{
+		EventTypeOrderCreated:         OrderStatusSucceeded,
+		EventTypeOrderRefundRequested: OrderStatusRefunded,
+	}
+)
+
+type (
+	TransitionError struct {
+		From OrderStatus
+		To   OrderStatus
+	}
+)
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("order cannot transition from %s to %s", e.From, e.To)
+}
+
+// Valid reports whether s is a known order status.
+func (s OrderStatus) Valid() bool {
+	for _, status := range orderStatuses {
+		if status == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Terminal reports whether no further transitions are possible from s.
+func (s OrderStatus) Terminal() bool {
+	return len(orderTransitions[s]) == 0
+}
+
+// CanTransitionTo reports whether an order in status s may move to next.
+func (s OrderStatus) CanTransitionTo(next OrderStatus) bool {
+	for _, allowed := range orderTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// Transition returns a *TransitionError when the move from s to next is illegal.
+func (s OrderStatus) Transition(next OrderStatus) error {
+	if !s.CanTransitionTo(next) {
+		return &TransitionError{From: s, To: next}
+	}
+	return nil
+}
+
+// shouldRelay reports whether an outbox event still makes sense for an order
+// currently in status s.
+func (s OrderStatus) shouldRelay(eventType string) bool {
+	next, ok := outboxEventTransitions[eventType]
+	if !ok {
+		return true
+	}
+	return s.CanTransitionTo(next)
+}
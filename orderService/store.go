@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/antithesishq/antithesis-sdk-go/assert"
+	"github.com/lib/pq"
 )
 
 var (
@@ -28,6 +29,7 @@ type (
 
 	PostgresStore struct {
 		config *Config
+		dbUrl  string
 		db     *sql.DB
 	}
 )
@@ -73,6 +75,7 @@ func NewPostgresStore(config *Config) (*PostgresStore, error) {
 
 	return &PostgresStore{
 		config: config,
+		dbUrl:  dbUrl.String(),
 		db:     db,
 	}, nil
 }
@@ -88,6 +91,22 @@ func (s *PostgresStore) Start(ctx context.Context) error {
 	return nil
 }
 
+// NewListener opens a dedicated connection that LISTENs on channel. The
+// listener reconnects on its own and sends a nil notification when it does,
+// since notifications may have been missed in between.
+func (s *PostgresStore) NewListener(channel string) (*pq.Listener, error) {
+	listener := pq.NewListener(s.dbUrl, time.Second, 30*time.Second, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Listener on %s: %v\n", channel, err)
+		}
+	})
+	if err := listener.Listen(channel); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to listen on %s: %w", channel, err)
+	}
+	return listener, nil
+}
+
 func (s *PostgresStore) Stop() error {
 	return s.db.Close()
 }
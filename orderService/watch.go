@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/antithesishq/antithesis-sdk-go/assert"
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	defaultWatchTimeout = 30 * time.Second
+	maxWatchTimeout     = 2 * time.Minute
+
+	// watchPollInterval bounds how stale a watcher can get when the status
+	// change happened on another replica and no local notification arrives.
+	watchPollInterval = 5 * time.Second
+	keepAliveInterval = 15 * time.Second
+)
+
+var (
+	errOrderNotFound = errors.New("order not found")
+)
+
+type (
+	// StatusBroadcaster fans out order status changes made by this process to
+	// the watchers of that order. Notifications only say that something
+	// changed; watchers re-read the order so they never act on stale data.
+	StatusBroadcaster struct {
+		mu          sync.Mutex
+		subscribers map[int64]map[chan struct{}]struct{}
+	}
+)
+
+func NewStatusBroadcaster() *StatusBroadcaster {
+	return &StatusBroadcaster{
+		subscribers: make(map[int64]map[chan struct{}]struct{}),
+	}
+}
+
+func (b *StatusBroadcaster) Subscribe(orderID int64) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subscribers[orderID] == nil {
+		b.subscribers[orderID] = make(map[chan struct{}]struct{})
+	}
+	b.subscribers[orderID][ch] = struct{}{}
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subscribers[orderID], ch)
+		if len(b.subscribers[orderID]) == 0 {
+			delete(b.subscribers, orderID)
+		}
+	}
+}
+
+// Publish must be called after the transaction that changed the order's
+// status has committed.
+func (b *StatusBroadcaster) Publish(orderID int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers[orderID] {
+		select {
+		case ch <- struct{}{}:
+		default: // A notification is already pending.
+		}
+	}
+}
+
+// Watch reports status changes of an order. Clients that accept
+// text/event-stream get a Server-Sent Events stream that ends once the order
+// reaches a terminal status; everyone else long-polls until the status
+// differs from since_status or the timeout elapses, and gets the order back.
+func (s *OrderService) Watch(w http.ResponseWriter, r *http.Request) {
+	assert.Always(s.started, "Service must be started before handling requests", Details{"op": "watch_order"})
+
+	orderIDURLParam := chi.URLParam(r, "orderID")
+	orderID, err := strconv.Atoi(orderIDURLParam)
+	if err != nil {
+		http.Error(w, "Failed to to process orderID", http.StatusBadRequest)
+		return
+	}
+
+	sinceStatus := OrderStatus(r.URL.Query().Get("since_status"))
+	if sinceStatus != "" && !sinceStatus.Valid() {
+		http.Error(w, fmt.Sprintf("unknown order status: %v", sinceStatus), http.StatusBadRequest)
+		return
+	}
+
+	timeout := defaultWatchTimeout
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		timeout, err = time.ParseDuration(v)
+		if err != nil || timeout <= 0 || timeout > maxWatchTimeout {
+			http.Error(w, fmt.Sprintf("timeout must be a duration up to %v: got %v", maxWatchTimeout, v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Subscribe before the first read so no change can slip in between.
+	notifications, unsubscribe := s.statuses.Subscribe(int64(orderID))
+	defer unsubscribe()
+
+	order, err := s.readOrder(r.Context(), int64(orderID))
+	if err != nil {
+		if err == errOrderNotFound {
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to get order", http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		s.streamStatus(ctx, w, order, notifications)
+		return
+	}
+
+	poll := time.NewTicker(watchPollInterval)
+	defer poll.Stop()
+
+	for sinceStatus != "" && order.Status == sinceStatus {
+		select {
+		case <-ctx.Done():
+			if r.Context().Err() != nil {
+				return
+			}
+			writeOrder(w, order)
+			return
+		case <-notifications:
+		case <-poll.C:
+		}
+		// Read with the request's context, so a change noticed right before
+		// the timeout is still served.
+		if order, err = s.readOrder(r.Context(), int64(orderID)); err != nil {
+			http.Error(w, "Failed to get order", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	assert.Sometimes(sinceStatus != "" && order.Status != sinceStatus, "Sometimes a watcher observes a status change", Details{"status": order.Status})
+	writeOrder(w, order)
+}
+
+func (s *OrderService) streamStatus(ctx context.Context, w http.ResponseWriter, order Order, notifications <-chan struct{}) {
+	rc := http.NewResponseController(w)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	poll := time.NewTicker(watchPollInterval)
+	defer poll.Stop()
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+
+	sent := OrderStatus("")
+	for {
+		if order.Status != sent {
+			data, err := json.Marshal(order)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "id: %d\nevent: status\ndata: %s\n\n", order.Version, data)
+			if err := rc.Flush(); err != nil {
+				return
+			}
+			sent = order.Status
+		}
+		if order.Status.Terminal() {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			if err := rc.Flush(); err != nil {
+				return
+			}
+			continue
+		case <-notifications:
+		case <-poll.C:
+		}
+
+		latest, err := s.readOrder(ctx, order.ID)
+		if err != nil {
+			return
+		}
+		order = latest
+	}
+}
+
+func (s *OrderService) readOrder(ctx context.Context, orderID int64) (Order, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Order{}, err
+	}
+	defer tx.Rollback()
+
+	order, err := getOrder(ctx, tx, orderID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return order, errOrderNotFound
+		}
+		return order, err
+	}
+	return order, tx.Commit()
+}
+
+func writeOrder(w http.ResponseWriter, order Order) {
+	out, err := json.Marshal(order)
+	if err != nil {
+		http.Error(w, "Failed to serialize response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(ETagHeader, orderETag(order.Version))
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/antithesishq/antithesis-sdk-go/assert"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stripe/stripe-go/v81"
+	"github.com/stripe/stripe-go/v81/charge"
+)
+
+const (
+	EventTypeOrderCreated     = "ORDER_CREATED"
+	EventTypePaymentSucceeded = "PAYMENT_SUCCEEDED"
+	EventTypePaymentFailed    = "PAYMENT_FAILED"
+
+	chargesSubject = "PAYMENTS.charges"
+)
+
+type (
+	PaymentOutcomeEvent struct {
+		OrderID       int64  `json:"order_id"`
+		ChargeID      string `json:"charge_id,omitempty"`
+		FailureReason string `json:"failure_reason,omitempty"`
+	}
+)
+
+// handleOrderCreated charges the order's customer, records the payment and
+// reports the outcome on PAYMENTS. Stripe declining the charge is an outcome;
+// anything else is returned so the message is redelivered. The payment and
+// the inbox record of the event commit together, so a redelivered event is
+// not charged again but has its recorded outcome reported again. A crash
+// between the charge and the commit is covered by the charge's idempotency
+// key instead: charging the event again replays the first charge.
+func handleOrderCreated(ctx context.Context, db *sql.DB, js jetstream.JetStream, charges *charge.Client, event CloudEvent) error {
+	var payment PaymentEvent
+	if err := json.Unmarshal(event.Data, &payment); err != nil {
+		return fmt.Errorf("failed to unmarshal order event %s: %w", event.ID, err)
+	}
+	orderID := payment.OrderID
+	assert.Always(orderID > 0, "Order created events must carry their order ID", map[string]any{"event_id": event.ID})
+	assert.Always(event.Subject == strconv.FormatInt(orderID, 10), "Order created events must be about the order in their payload", map[string]any{"subject": event.Subject, "order_id": orderID})
+	assert.Always(payment.EventID == event.ID, "Order created events must carry their own event ID", map[string]any{"event_id": event.ID, "payload_event_id": payment.EventID})
+	if orderID <= 0 {
+		return fmt.Errorf("order event %s has no order ID", event.ID)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	first, err := recordInboxMessage(ctx, tx, event)
+	if err != nil {
+		return err
+	}
+	if !first {
+		// The outcome may not have been published before the crash that
+		// caused the redelivery.
+		recorded, err := scanPayment(tx.QueryRowContext(ctx, getPaymentByEventQuery, event.ID))
+		if err != nil {
+			return fmt.Errorf("failed to get payment of order event %s: %w", event.ID, err)
+		}
+		assert.Sometimes(true, "Sometimes an order is redelivered after it was charged", map[string]any{"order_id": orderID})
+		log.Printf("Order %d was already charged, reporting its outcome again", orderID)
+		return publishPaymentOutcome(ctx, js, event.ID, recorded)
+	}
+
+	charged, err := chargeOrder(ctx, charges, event.ID, payment)
+	if err != nil {
+		return err
+	}
+
+	recorded, err := scanPayment(tx.QueryRowContext(
+		ctx,
+		insertPaymentQuery,
+		charged.EventID,
+		charged.OrderID,
+		charged.ChargeID,
+		charged.Amount,
+		charged.Currency,
+		charged.Status,
+		charged.FailureReason,
+		time.Now().Unix(),
+	))
+	if err != nil {
+		return fmt.Errorf("failed to record payment of order %d: %w", orderID, err)
+	}
+	assert.AlwaysOrUnreachable(recorded.Status == charged.Status, "Recorded payments must have the charge's status", map[string]any{"order_id": orderID, "status": recorded.Status})
+	assert.AlwaysOrUnreachable(recorded.Amount == payment.Amount, "Recorded payments must have the charged amount", map[string]any{"order_id": orderID, "amount": recorded.Amount})
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	// The outcome reuses the order event's ID, so it is the same for every
+	// delivery of that event.
+	return publishPaymentOutcome(ctx, js, event.ID, recorded)
+}
+
+// chargeOrder asks Stripe, through charges, to charge the order of the
+// ORDER_CREATED event eventID. It returns the payment to record, which is
+// failed when Stripe declined the charge.
+func chargeOrder(ctx context.Context, charges *charge.Client, eventID string, payment PaymentEvent) (Payment, error) {
+	assert.Always(payment.Amount > 0, "Charge amounts must be positive", map[string]any{"order_id": payment.OrderID, "amount": payment.Amount})
+
+	params := &stripe.ChargeParams{
+		Amount:      stripe.Int64(payment.Amount),
+		Currency:    stripe.String(payment.Currency),
+		Customer:    stripe.String(payment.Customer),
+		Description: stripe.String(payment.Description),
+	}
+	params.Context = ctx
+	params.SetIdempotencyKey(chargeIdempotencyKey(eventID))
+	params.AddMetadata("order_id", strconv.FormatInt(payment.OrderID, 10))
+	params.AddMetadata("order_event_id", eventID)
+	params.AddMetadata("order_created_at", strconv.FormatInt(payment.CreatedAt, 10))
+
+	charged := Payment{
+		EventID:  eventID,
+		OrderID:  payment.OrderID,
+		Amount:   payment.Amount,
+		Currency: payment.Currency,
+		Status:   PaymentStatusSucceeded,
+	}
+
+	ch, err := charges.New(params)
+	if err != nil {
+		var stripeErr *stripe.Error
+		if !errors.As(err, &stripeErr) || stripeErr.HTTPStatusCode < 400 || stripeErr.HTTPStatusCode >= 500 {
+			return charged, fmt.Errorf("failed to charge order %d: %w", payment.OrderID, err)
+		}
+		if stripeErr.Type == stripe.ErrorTypeIdempotency || stripeErr.Code == stripe.ErrorCodeIdempotencyKeyInUse {
+			// The key is in use by a charge still in flight, or by one with
+			// other parameters. Neither means the order was declined.
+			assert.Unreachable("Charges of an order event must reuse the same parameters", map[string]any{"event_id": eventID, "error": stripeErr.Msg})
+			return charged, fmt.Errorf("failed to charge order %d: %w", payment.OrderID, err)
+		}
+		log.Printf("Stripe declined the charge of order %d: %v", payment.OrderID, stripeErr.Msg)
+		charged.Status = PaymentStatusFailed
+		charged.FailureReason = &stripeErr.Msg
+		return charged, nil
+	}
+
+	replayed := ch.LastResponse != nil && ch.LastResponse.Header.Get("Idempotent-Replayed") == "true"
+	log.Printf("Successfully charged customer %s for order %d: %s (replayed: %t)", payment.Customer, payment.OrderID, ch.ID, replayed)
+	charged.ChargeID = &ch.ID
+	return charged, nil
+}
+
+// chargeIdempotencyKey is the Stripe idempotency key of the charge of the
+// ORDER_CREATED event eventID, so every delivery of the event charges once.
+// Order IDs cannot be used, as the order service reuses them after a reset.
+func chargeIdempotencyKey(eventID string) string {
+	return "order-created-" + eventID
+}
+
+// publishPaymentOutcome reports a recorded payment as the outcome of the
+// order event eventID.
+func publishPaymentOutcome(ctx context.Context, js jetstream.JetStream, eventID string, payment Payment) error {
+	outcome := PaymentOutcomeEvent{OrderID: payment.OrderID}
+	eventType := EventTypePaymentSucceeded
+	if payment.ChargeID != nil {
+		outcome.ChargeID = *payment.ChargeID
+	}
+	if payment.Status == PaymentStatusFailed {
+		eventType = EventTypePaymentFailed
+		if payment.FailureReason != nil {
+			outcome.FailureReason = *payment.FailureReason
+		}
+	}
+
+	outcomeData, err := json.Marshal(outcome)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payment outcome: %w", err)
+	}
+	return publishCloudEvent(ctx, js, chargesSubject, newPaymentCloudEvent(eventID, eventType, payment.OrderID, outcomeData))
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestChargeOrderReusedOrderIDChargesAgain(t *testing.T) {
+	fake, charges, _ := newFakeStripe(t)
+
+	// The order service reuses order IDs after a reset, so the same order ID
+	// with another event is another order.
+	payment := PaymentEvent{OrderID: 1, CreatedAt: 1700000000, Amount: 1999, Currency: "usd", Customer: "cus_123", Description: "order 1"}
+	for _, eventID := range []string{"5d3c1f0e-8a52-4d3e-9a55-0f5cf1a6e2b7", "0b6f9e4a-2f1d-4c5b-8e7a-3d2c1b0a9f8e"} {
+		payment.EventID = eventID
+		if _, err := chargeOrder(context.Background(), charges, eventID, payment); err != nil {
+			t.Fatalf("event %s: %v", eventID, err)
+		}
+	}
+
+	if fake.charges != 2 {
+		t.Errorf("got %d charges, want 2", fake.charges)
+	}
+}
+
+// TestHandleMessageRedeliveredOrderCreatedChargesOnce delivers the same
+// ORDER_CREATED event twice, the first delivery being acked or nak'd after a
+// failure, and checks the order is charged and reported once.
+func TestHandleMessageRedeliveredOrderCreatedChargesOnce(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		failCommits   int
+		failPublishes int
+		wantFirst     string
+	}{
+		{name: "after ack", wantFirst: "ack"},
+		{name: "after failed commit", failCommits: 1, wantFirst: "nak"},
+		{name: "after failed publish", failPublishes: 1, wantFirst: "nak"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake, charges, refunds := newFakeStripe(t)
+			db, sqlDB := newFakeDB(t)
+			db.failCommits = tc.failCommits
+			js := newFakeJetStream()
+			js.failPublishes = tc.failPublishes
+
+			eventID := "5d3c1f0e-8a52-4d3e-9a55-0f5cf1a6e2b7"
+			msg := newOrderServiceMessage(t, eventID, EventTypeOrderCreated, 1, PaymentEvent{
+				OrderID:          1,
+				EventID:          eventID,
+				CreatedAt:        1700000000,
+				Amount:           1999,
+				Currency:         "usd",
+				Customer:         "cus_123",
+				Description:      "order 1",
+				CurrencyExponent: 2,
+			})
+
+			first, second := &fakeMsg{data: msg}, &fakeMsg{data: msg}
+			handleMessage(sqlDB, js, charges, refunds, first)
+			handleMessage(sqlDB, js, charges, refunds, second)
+
+			if first.settled != tc.wantFirst || second.settled != "ack" {
+				t.Errorf("deliveries were settled with %q and %q, want %q and %q", first.settled, second.settled, tc.wantFirst, "ack")
+			}
+			if fake.charges != 1 {
+				t.Errorf("got %d charges, want 1", fake.charges)
+			}
+			if n := db.rows("payments"); n != 1 {
+				t.Errorf("got %d recorded payments, want 1", n)
+			}
+			published := js.published()
+			if len(published) != 1 {
+				t.Fatalf("got %d outcome events, want 1", len(published))
+			}
+			if published[0].ID != eventID || published[0].Type != EventTypePaymentSucceeded {
+				t.Errorf("got outcome %s %s, want %s %s", published[0].Type, published[0].ID, EventTypePaymentSucceeded, eventID)
+			}
+			var outcome PaymentOutcomeEvent
+			if err := json.Unmarshal(published[0].Data, &outcome); err != nil {
+				t.Fatal(err)
+			}
+			if outcome.OrderID != 1 || outcome.ChargeID != "ch_1" {
+				t.Errorf("got outcome %+v, want order 1 charged with ch_1", outcome)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	CloudEventsSpecVersion = "1.0"
+
+	// CloudEventsContentType marks a NATS message whose data is a CloudEvent
+	// in structured mode, i.e. the JSON envelope carries the attributes.
+	CloudEventsContentType = "application/cloudevents+json"
+	ContentTypeHeader      = "Content-Type"
+
+	paymentServiceSource = "/payment-service"
+)
+
+type (
+	// CloudEvent is a CloudEvents 1.0 envelope in the JSON event format.
+	// Events of the order service carry the order ID as Subject.
+	CloudEvent struct {
+		SpecVersion     string          `json:"specversion"`
+		ID              string          `json:"id"`
+		Source          string          `json:"source"`
+		Type            string          `json:"type"`
+		Subject         string          `json:"subject,omitempty"`
+		Time            string          `json:"time,omitempty"`
+		DataContentType string          `json:"datacontenttype,omitempty"`
+		Data            json.RawMessage `json:"data"`
+	}
+)
+
+// newPaymentCloudEvent wraps an outcome about orderID. The ID must be the
+// same for every report of the same outcome, so consumers can deduplicate.
+func newPaymentCloudEvent(id, eventType string, orderID int64, data json.RawMessage) CloudEvent {
+	return CloudEvent{
+		SpecVersion:     CloudEventsSpecVersion,
+		ID:              id,
+		Source:          paymentServiceSource,
+		Type:            eventType,
+		Subject:         strconv.FormatInt(orderID, 10),
+		Time:            time.Now().UTC().Format(time.RFC3339),
+		DataContentType: "application/json",
+		Data:            data,
+	}
+}
+
+// parseCloudEvent decodes a structured-mode CloudEvent and checks the
+// attributes every event must have.
+func parseCloudEvent(data []byte) (CloudEvent, error) {
+	var event CloudEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return event, fmt.Errorf("invalid cloud event: %w", err)
+	}
+	if event.SpecVersion != CloudEventsSpecVersion {
+		return event, fmt.Errorf("unsupported cloud event spec version: %q", event.SpecVersion)
+	}
+	if event.ID == "" || event.Source == "" || event.Type == "" {
+		return event, fmt.Errorf("cloud event must have an id, source and type")
+	}
+	return event, nil
+}
+
+// publishCloudEvent publishes event in structured mode and waits for the
+// stream to store it. The event ID is the message ID, so publishing the same
+// outcome again after a redelivery is dropped by JetStream.
+func publishCloudEvent(ctx context.Context, js jetstream.JetStream, subject string, event CloudEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal cloud event: %w", err)
+	}
+	msg := &nats.Msg{
+		Subject: subject,
+		Header:  nats.Header{ContentTypeHeader: []string{CloudEventsContentType}},
+		Data:    data,
+	}
+	if _, err := js.PublishMsg(ctx, msg, jetstream.WithMsgID(event.ID)); err != nil {
+		return fmt.Errorf("failed to publish %s: %w", event.Type, err)
+	}
+	log.Printf("Published %s %s to %s", event.Type, event.ID, subject)
+	return nil
+}
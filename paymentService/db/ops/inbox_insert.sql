@@ -0,0 +1,12 @@
+INSERT INTO payments.inbox (
+    message_id,
+    event_type,
+    processed_at
+)
+VALUES (
+    $1,
+    $2,
+    $3
+)
+ON CONFLICT (message_id) DO NOTHING
+RETURNING message_id;
@@ -0,0 +1,16 @@
+-- The latest payment of the order, as earlier ones may belong to an order
+-- that had the same ID before the order service was reset.
+SELECT
+    event_id,
+    order_id,
+    charge_id,
+    amount,
+    currency,
+    status,
+    failure_reason,
+    created_at,
+    updated_at
+FROM payments.payments
+WHERE order_id = $1
+ORDER BY created_at DESC, event_id
+LIMIT 1;
@@ -0,0 +1,12 @@
+SELECT
+    event_id,
+    order_id,
+    charge_id,
+    amount,
+    currency,
+    status,
+    failure_reason,
+    created_at,
+    updated_at
+FROM payments.payments
+WHERE event_id = $1;
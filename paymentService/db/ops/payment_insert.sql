@@ -0,0 +1,32 @@
+INSERT INTO payments.payments (
+    event_id,
+    order_id,
+    charge_id,
+    amount,
+    currency,
+    status,
+    failure_reason,
+    created_at,
+    updated_at
+)
+VALUES (
+    $1,
+    $2,
+    $3,
+    $4,
+    $5,
+    $6,
+    $7,
+    $8,
+    $8
+)
+RETURNING
+    event_id,
+    order_id,
+    charge_id,
+    amount,
+    currency,
+    status,
+    failure_reason,
+    created_at,
+    updated_at;
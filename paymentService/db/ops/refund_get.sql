@@ -0,0 +1,13 @@
+SELECT
+    refund_id,
+    order_id,
+    charge_id,
+    stripe_refund_id,
+    amount,
+    currency,
+    status,
+    failure_reason,
+    created_at,
+    updated_at
+FROM payments.refunds
+WHERE refund_id = $1;
@@ -0,0 +1,35 @@
+INSERT INTO payments.refunds (
+    refund_id,
+    order_id,
+    charge_id,
+    stripe_refund_id,
+    amount,
+    currency,
+    status,
+    failure_reason,
+    created_at,
+    updated_at
+)
+VALUES (
+    $1,
+    $2,
+    $3,
+    $4,
+    $5,
+    $6,
+    $7,
+    $8,
+    $9,
+    $9
+)
+RETURNING
+    refund_id,
+    order_id,
+    charge_id,
+    stripe_refund_id,
+    amount,
+    currency,
+    status,
+    failure_reason,
+    created_at,
+    updated_at;
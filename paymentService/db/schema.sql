@@ -0,0 +1,48 @@
+-- The payment service owns the payments schema. Unlike the order service's
+-- tables it is never dropped, as it is the record of what Stripe charged.
+CREATE SCHEMA IF NOT EXISTS payments;
+
+-- Payments are keyed by the ORDER_CREATED event they charge. Order IDs are
+-- not unique over time, as the order service resets its tables on start.
+CREATE TABLE IF NOT EXISTS payments.payments (
+    event_id       TEXT PRIMARY KEY,
+    order_id       BIGINT NOT NULL,
+    charge_id      TEXT, -- null unless the charge succeeded
+    amount         BIGINT NOT NULL, -- minor units of currency
+    currency       TEXT NOT NULL,
+    status         TEXT NOT NULL,
+    failure_reason TEXT,
+    created_at     BIGINT NOT NULL,
+    updated_at     BIGINT NOT NULL,
+
+    CONSTRAINT payment_status CHECK (status IN ('succeeded', 'failed')),
+    CONSTRAINT payment_charge CHECK (status <> 'succeeded' OR charge_id IS NOT NULL)
+);
+
+CREATE INDEX IF NOT EXISTS payments_order_id_idx ON payments.payments (order_id, created_at);
+
+-- One row per message whose effect is committed, keyed by its CloudEvent ID,
+-- so redeliveries are recognised instead of handled again.
+CREATE TABLE IF NOT EXISTS payments.inbox (
+    message_id   TEXT PRIMARY KEY,
+    event_type   TEXT NOT NULL,
+    processed_at BIGINT NOT NULL
+);
+
+-- Refunds are keyed by the order service's refund ID, which is also their
+-- Stripe idempotency key.
+CREATE TABLE IF NOT EXISTS payments.refunds (
+    refund_id        TEXT PRIMARY KEY,
+    order_id         BIGINT NOT NULL,
+    charge_id        TEXT NOT NULL,
+    stripe_refund_id TEXT, -- null unless the refund succeeded
+    amount           BIGINT NOT NULL, -- minor units of currency
+    currency         TEXT NOT NULL,
+    status           TEXT NOT NULL,
+    failure_reason   TEXT,
+    created_at       BIGINT NOT NULL,
+    updated_at       BIGINT NOT NULL,
+
+    CONSTRAINT refund_status CHECK (status IN ('succeeded', 'failed')),
+    CONSTRAINT refund_stripe_refund CHECK (status <> 'succeeded' OR stripe_refund_id IS NOT NULL)
+);
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stripe/stripe-go/v81"
+	"github.com/stripe/stripe-go/v81/charge"
+	"github.com/stripe/stripe-go/v81/refund"
+)
+
+// fakeStripe serves POST /v1/charges and POST /v1/refunds and, like Stripe,
+// stores the response of each Idempotency-Key and replays it for requests
+// reusing the key. Refunds of the charge ID declinedCharge are rejected.
+type fakeStripe struct {
+	mu        sync.Mutex
+	responses map[string]string
+	charges   int
+	refunds   int
+}
+
+const declinedCharge = "ch_declined"
+
+func (f *fakeStripe) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || (r.URL.Path != "/v1/charges" && r.URL.Path != "/v1/refunds") {
+		http.NotFound(w, r)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	key := r.Header.Get("Idempotency-Key")
+	if response, ok := f.responses[key]; ok {
+		w.Header().Set("Idempotent-Replayed", "true")
+		fmt.Fprint(w, response)
+		return
+	}
+
+	var response string
+	switch {
+	case r.URL.Path == "/v1/charges":
+		f.charges++
+		response = fmt.Sprintf(
+			`{"id": "ch_%d", "object": "charge", "amount": %s, "currency": %q, "status": "succeeded", "metadata": {"order_id": %q}}`,
+			f.charges, r.PostForm.Get("amount"), r.PostForm.Get("currency"), r.PostForm.Get("metadata[order_id]"),
+		)
+	case r.PostForm.Get("charge") == declinedCharge:
+		// Stripe does not store responses to invalid requests.
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error": {"type": "invalid_request_error", "message": "Charge ch_declined has already been refunded."}}`)
+		return
+	default:
+		f.refunds++
+		response = fmt.Sprintf(
+			`{"id": "re_%d", "object": "refund", "amount": %s, "charge": %q, "status": "succeeded"}`,
+			f.refunds, r.PostForm.Get("amount"), r.PostForm.Get("charge"),
+		)
+	}
+	f.responses[key] = response
+	fmt.Fprint(w, response)
+}
+
+// newFakeStripe starts a fakeStripe and returns the clients the service
+// would use to talk to it.
+func newFakeStripe(t *testing.T) (*fakeStripe, *charge.Client, *refund.Client) {
+	t.Helper()
+
+	fake := &fakeStripe{responses: make(map[string]string)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	backend := stripe.GetBackendWithConfig(stripe.APIBackend, &stripe.BackendConfig{
+		URL:               stripe.String(server.URL),
+		MaxNetworkRetries: stripe.Int64(0),
+		LeveledLogger:     &stripe.LeveledLogger{Level: stripe.LevelError},
+	})
+	return fake, &charge.Client{B: backend, Key: "sk_test_123"}, &refund.Client{B: backend, Key: "sk_test_123"}
+}
+
+// fakeDB is an in-memory database/sql driver that understands the statements
+// in db/ops the handlers run, so handlers can be tested without Postgres.
+// Writes of a transaction are only visible to it until it commits.
+type fakeDB struct {
+	mu     sync.Mutex
+	tables map[string]map[string][]driver.Value // Rows by table and primary key.
+
+	// failCommits is how many of the next commits fail, e.g. because the
+	// connection dropped.
+	failCommits int
+}
+
+func newFakeDB(t *testing.T) (*fakeDB, *sql.DB) {
+	t.Helper()
+
+	fake := &fakeDB{tables: make(map[string]map[string][]driver.Value)}
+	db := sql.OpenDB(fake)
+	t.Cleanup(func() { db.Close() })
+	return fake, db
+}
+
+func (f *fakeDB) Connect(context.Context) (driver.Conn, error) { return &fakeConn{db: f}, nil }
+func (f *fakeDB) Driver() driver.Driver                        { return f }
+func (f *fakeDB) Open(string) (driver.Conn, error)             { return &fakeConn{db: f}, nil }
+
+// rows returns how many rows table holds.
+func (f *fakeDB) rows(table string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.tables[table])
+}
+
+type (
+	fakeConn struct {
+		db *fakeDB
+		tx *fakeTx
+	}
+
+	fakeTx struct {
+		conn   *fakeConn
+		writes map[string]map[string][]driver.Value
+	}
+
+	fakeRows struct {
+		rows [][]driver.Value
+	}
+)
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("fakeDB: prepared statements are not supported")
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	c.tx = &fakeTx{conn: c, writes: make(map[string]map[string][]driver.Value)}
+	return c.tx, nil
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+
+	switch query {
+	case insertInboxMessageQuery:
+		if _, ok := c.lookup("inbox", values[0]); ok {
+			return &fakeRows{}, nil
+		}
+		if err := c.insert("inbox", values); err != nil {
+			return nil, err
+		}
+		return &fakeRows{rows: [][]driver.Value{{values[0]}}}, nil
+	case insertPaymentQuery, insertRefundQuery:
+		table := "payments"
+		if query == insertRefundQuery {
+			table = "refunds"
+		}
+		// The last argument is both created_at and updated_at.
+		row := append(values, values[len(values)-1])
+		if err := c.insert(table, row); err != nil {
+			return nil, err
+		}
+		return &fakeRows{rows: [][]driver.Value{row}}, nil
+	case getPaymentByEventQuery, getRefundQuery:
+		table := "payments"
+		if query == getRefundQuery {
+			table = "refunds"
+		}
+		row, ok := c.lookup(table, values[0])
+		if !ok {
+			return &fakeRows{}, nil
+		}
+		return &fakeRows{rows: [][]driver.Value{row}}, nil
+	}
+	return nil, fmt.Errorf("fakeDB: unsupported query: %s", query)
+}
+
+// lookup finds the row of table with primary key key, as seen by the
+// connection's transaction.
+func (c *fakeConn) lookup(table string, key driver.Value) ([]driver.Value, bool) {
+	if c.tx != nil {
+		if row, ok := c.tx.writes[table][key.(string)]; ok {
+			return row, true
+		}
+	}
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	row, ok := c.db.tables[table][key.(string)]
+	return row, ok
+}
+
+// insert adds row, whose first value is the primary key, to table.
+func (c *fakeConn) insert(table string, row []driver.Value) error {
+	if c.tx == nil {
+		return errors.New("fakeDB: writes need a transaction")
+	}
+	if _, ok := c.lookup(table, row[0]); ok {
+		return fmt.Errorf("fakeDB: duplicate key %v in %s", row[0], table)
+	}
+	if c.tx.writes[table] == nil {
+		c.tx.writes[table] = make(map[string][]driver.Value)
+	}
+	c.tx.writes[table][row[0].(string)] = row
+	return nil
+}
+
+func (tx *fakeTx) Commit() error {
+	tx.conn.tx = nil
+
+	db := tx.conn.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.failCommits > 0 {
+		db.failCommits--
+		return driver.ErrBadConn
+	}
+	for table, rows := range tx.writes {
+		if db.tables[table] == nil {
+			db.tables[table] = make(map[string][]driver.Value)
+		}
+		for key, row := range rows {
+			db.tables[table][key] = row
+		}
+	}
+	return nil
+}
+
+func (tx *fakeTx) Rollback() error {
+	tx.conn.tx = nil
+	return nil
+}
+
+func (r *fakeRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return nil
+	}
+	return make([]string, len(r.rows[0]))
+}
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// fakeJetStream stores published messages and, like a stream with a
+// duplicate window, drops messages whose ID it already stored. Message IDs
+// are the IDs of the CloudEvents published, as in publishCloudEvent.
+type fakeJetStream struct {
+	jetstream.JetStream
+
+	mu       sync.Mutex
+	messages []CloudEvent
+	ids      map[string]bool
+
+	// failPublishes is how many of the next publishes fail.
+	failPublishes int
+}
+
+func newFakeJetStream() *fakeJetStream {
+	return &fakeJetStream{ids: make(map[string]bool)}
+}
+
+func (js *fakeJetStream) PublishMsg(ctx context.Context, msg *nats.Msg, opts ...jetstream.PublishOpt) (*jetstream.PubAck, error) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	if js.failPublishes > 0 {
+		js.failPublishes--
+		return nil, nats.ErrTimeout
+	}
+	var event CloudEvent
+	if err := json.Unmarshal(msg.Data, &event); err != nil {
+		return nil, err
+	}
+	if js.ids[event.ID] {
+		return &jetstream.PubAck{Stream: PaymentsStream, Sequence: uint64(len(js.messages)), Duplicate: true}, nil
+	}
+	js.ids[event.ID] = true
+	js.messages = append(js.messages, event)
+	return &jetstream.PubAck{Stream: PaymentsStream, Sequence: uint64(len(js.messages))}, nil
+}
+
+// published returns the CloudEvents the stream stored.
+func (js *fakeJetStream) published() []CloudEvent {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	return append([]CloudEvent(nil), js.messages...)
+}
+
+// fakeMsg is one delivery of a message, recording how it was settled.
+type fakeMsg struct {
+	jetstream.Msg
+
+	data    []byte
+	settled string // "ack", "nak" or "term".
+}
+
+func (m *fakeMsg) Data() []byte                     { return m.data }
+func (m *fakeMsg) Ack() error                       { m.settled = "ack"; return nil }
+func (m *fakeMsg) NakWithDelay(time.Duration) error { m.settled = "nak"; return nil }
+func (m *fakeMsg) Term() error                      { m.settled = "term"; return nil }
+
+// newOrderServiceMessage returns the data of a message the order service
+// relays, a CloudEvent about orderID with data as its payload.
+func newOrderServiceMessage(t *testing.T, id, eventType string, orderID int64, data any) []byte {
+	t.Helper()
+
+	payload, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := json.Marshal(CloudEvent{
+		SpecVersion: CloudEventsSpecVersion,
+		ID:          id,
+		Source:      "/order-service",
+		Type:        eventType,
+		Subject:     strconv.FormatInt(orderID, 10),
+		Data:        payload,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
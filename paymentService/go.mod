@@ -4,6 +4,7 @@ go 1.23.3
 
 require (
 	github.com/antithesishq/antithesis-sdk-go v0.4.2
+	github.com/lib/pq v1.10.9
 	github.com/nats-io/nats.go v1.37.0
 	github.com/stripe/stripe-go/v81 v81.1.0
 )
@@ -2,21 +2,34 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"flag"
 	"log"
+	"net/http"
 	"time"
 
 	"github.com/nats-io/nats.go/jetstream"
 	"github.com/stripe/stripe-go/v81"
 	"github.com/stripe/stripe-go/v81/charge"
+	"github.com/stripe/stripe-go/v81/refund"
 )
 
 type (
+	// PaymentEvent is the data of ORDER_CREATED events. It must follow the
+	// order service's eventschema/schemas/ORDER_CREATED.v2.json, which
+	// TestEventsFollowOrderEventSchemas checks.
 	PaymentEvent struct {
-		Amount      float64 `json:"amount"`
-		Currency    string  `json:"currency"`
-		Customer    string  `json:"customer"`
-		Description string  `json:"description"`
+		OrderID     int64  `json:"order_id"`
+		EventID     string `json:"event_id"` // ID of the order service's outbox event.
+		CreatedAt   int64  `json:"created_at"`
+		Amount      int64  `json:"amount"` // Minor units of Currency, as Stripe expects.
+		Currency    string `json:"currency"`
+		Customer    string `json:"customer"`
+		Description string `json:"description"`
+
+		// CurrencyExponent is the number of minor-unit digits of Currency,
+		// e.g. 2 for usd and 0 for jpy.
+		CurrencyExponent int `json:"currency_exponent"`
 	}
 )
 
@@ -24,8 +37,10 @@ func main() {
 
 	// Nats Consumer.
 
+	dbHostPtr := flag.String("db-host", "postgres", "Database host address")
 	natsURLPtr := flag.String("nats-url", "nats://nats:4222", "NATS URL")
-	// stripeBaseURL := flag.String("stripe-based-url", "http://stripe-mock:12111", "Stripe Base URL")
+	stripeBaseURLPtr := flag.String("stripe-base-url", "http://stripe-mock:12111", "Stripe Base URL")
+	flag.Parse()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
@@ -46,7 +61,43 @@ func main() {
 	}
 	defer jetStreamStore.Stop()
 
-	c, _ := jetStreamStore.js.CreateOrUpdateConsumer(ctx, "ORDERS", jetstream.ConsumerConfig{
+	// Payments ledger.
+
+	log.Printf("Connecting to database...\n")
+	store, err := NewPostgresStore(&Config{
+		Username: "guergabo",
+		Password: "password",
+		Host:     *dbHostPtr,
+		Port:     "5432",
+		Database: "postgres",
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := store.Start(ctx); err != nil {
+		log.Fatal(err)
+	}
+	defer store.Stop()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /payments/{orderID}", GetPayment(store.db))
+	go func() {
+		log.Printf("Starting HTTP server on port 8000...\n")
+		if err := http.ListenAndServe(":8000", mux); err != nil {
+			log.Fatalf("HTTP server error: %v\n", err)
+		}
+	}()
+
+	// Stripe API. (TODO: weird auth key issue...)
+
+	stripe.Key = "sk_test_123"
+	stripeBackend := stripe.GetBackendWithConfig(stripe.APIBackend, &stripe.BackendConfig{
+		URL: stripe.String(*stripeBaseURLPtr),
+	})
+	charges := &charge.Client{B: stripeBackend, Key: stripe.Key}
+	refunds := &refund.Client{B: stripeBackend, Key: stripe.Key}
+
+	c, _ := jetStreamStore.js.CreateOrUpdateConsumer(ctx, OrdersStream, jetstream.ConsumerConfig{
 		Durable:   "CONS",
 		AckPolicy: jetstream.AckExplicitPolicy,
 	})
@@ -65,29 +116,43 @@ func main() {
 		}
 
 		for msg := range msgs.Messages() {
-			msg.Ack()
 			log.Printf("Received a JetStream message via fetch: %s\n", string(msg.Data()))
+			handleMessage(store.db, jetStreamStore.js, charges, refunds, msg)
 		}
 	}
+}
 
-	// Stripe API. (TODO: weird auth key issue...)
-
-	stripe.Key = "sk_test_123"
-
-	params := &stripe.ChargeParams{
-		Amount:      stripe.Int64(int64(100 * 100)), // Convert to cents
-		Currency:    stripe.String(string(stripe.CurrencyUSD)),
-		Customer:    stripe.String("cus_test_123"),
-		Description: stripe.String("Payment service charge"),
-	}
-
-	params.Context = ctx
+// handleMessage dispatches on the type of the CloudEvent in msg. Messages
+// are acked only once their outcome is published, and nak'd on errors worth
+// retrying.
+func handleMessage(db *sql.DB, js jetstream.JetStream, charges *charge.Client, refunds *refund.Client, msg jetstream.Msg) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
 
-	ch, err := charge.New(params)
+	event, err := parseCloudEvent(msg.Data())
 	if err != nil {
-		log.Printf("Error creating charge for customer %s: %v", "Alice", err)
+		// Redelivering a malformed message cannot fix it.
+		log.Printf("Dropping malformed message: %v", err)
+		msg.Term()
 		return
 	}
 
-	log.Printf("Successfully charged customer %s: %s", "Alice", ch.ID)
+	switch event.Type {
+	case EventTypeOrderCreated:
+		if err := handleOrderCreated(ctx, db, js, charges, event); err != nil {
+			log.Printf("Error handling %s %s: %v", event.Type, event.ID, err)
+			msg.NakWithDelay(time.Second)
+			return
+		}
+		msg.Ack()
+	case EventTypeOrderRefundRequested:
+		if err := handleRefundRequested(ctx, db, js, refunds, event); err != nil {
+			log.Printf("Error handling %s %s: %v", event.Type, event.ID, err)
+			msg.NakWithDelay(time.Second)
+			return
+		}
+		msg.Ack()
+	default:
+		msg.Ack()
+	}
 }
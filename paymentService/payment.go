@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	PaymentStatusSucceeded PaymentStatus = "succeeded"
+	PaymentStatusFailed    PaymentStatus = "failed"
+)
+
+var (
+	//go:embed db/ops/inbox_insert.sql
+	insertInboxMessageQuery string
+
+	//go:embed db/ops/payment_insert.sql
+	insertPaymentQuery string
+
+	//go:embed db/ops/payment_get.sql
+	getPaymentQuery string
+
+	//go:embed db/ops/payment_get_by_event.sql
+	getPaymentByEventQuery string
+)
+
+type (
+	PaymentStatus string
+
+	// Payment is the ledger entry of the charge of an order. There is at most
+	// one per ORDER_CREATED event, whose ID is EventID.
+	Payment struct {
+		EventID       string        `json:"event_id"`
+		OrderID       int64         `json:"order_id"`
+		ChargeID      *string       `json:"charge_id,omitempty"`
+		Amount        int64         `json:"amount"` // Minor units of Currency.
+		Currency      string        `json:"currency"`
+		Status        PaymentStatus `json:"status"`
+		FailureReason *string       `json:"failure_reason,omitempty"`
+		CreatedAt     int64         `json:"created_at"`
+		UpdatedAt     int64         `json:"updated_at"`
+	}
+
+	rowScanner interface {
+		Scan(dest ...any) error
+	}
+)
+
+// recordInboxMessage records event as handled within tx. It reports false
+// when the event was already handled by a committed transaction. A
+// concurrent delivery of the same event blocks until the first transaction
+// ends, so only one of them ever handles it.
+func recordInboxMessage(ctx context.Context, tx *sql.Tx, event CloudEvent) (bool, error) {
+	var messageID string
+	err := tx.QueryRowContext(ctx, insertInboxMessageQuery, event.ID, event.Type, time.Now().Unix()).Scan(&messageID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to record message %s: %w", event.ID, err)
+	}
+	return true, nil
+}
+
+func scanPayment(row rowScanner) (Payment, error) {
+	var payment Payment
+	err := row.Scan(
+		&payment.EventID,
+		&payment.OrderID,
+		&payment.ChargeID,
+		&payment.Amount,
+		&payment.Currency,
+		&payment.Status,
+		&payment.FailureReason,
+		&payment.CreatedAt,
+		&payment.UpdatedAt,
+	)
+	return payment, err
+}
+
+// GetPayment serves GET /payments/{orderID}, the latest payment of the order.
+func GetPayment(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orderID, err := strconv.ParseInt(r.PathValue("orderID"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid order ID", http.StatusBadRequest)
+			return
+		}
+
+		payment, err := scanPayment(db.QueryRowContext(r.Context(), getPaymentQuery, orderID))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Payment not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, fmt.Sprintf("Failed to get payment: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		out, err := json.Marshal(payment)
+		if err != nil {
+			http.Error(w, "Failed to serialize response", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(out)
+	}
+}
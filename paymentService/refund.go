@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/antithesishq/antithesis-sdk-go/assert"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stripe/stripe-go/v81"
+	"github.com/stripe/stripe-go/v81/refund"
+)
+
+const (
+	EventTypeOrderRefundRequested = "ORDER_REFUND_REQUESTED"
+	EventTypeRefundSucceeded      = "REFUND_SUCCEEDED"
+	EventTypeRefundFailed         = "REFUND_FAILED"
+
+	RefundStatusSucceeded RefundStatus = "succeeded"
+	RefundStatusFailed    RefundStatus = "failed"
+
+	refundsSubject = "PAYMENTS.refunds"
+)
+
+var (
+	//go:embed db/ops/refund_insert.sql
+	insertRefundQuery string
+
+	//go:embed db/ops/refund_get.sql
+	getRefundQuery string
+)
+
+type (
+	RefundStatus string
+
+	// RefundRequestedEvent is the data of ORDER_REFUND_REQUESTED events. It
+	// must follow the order service's
+	// eventschema/schemas/ORDER_REFUND_REQUESTED.v1.json, which
+	// TestEventsFollowOrderEventSchemas checks.
+	RefundRequestedEvent struct {
+		RefundID string `json:"refund_id"`
+		OrderID  int64  `json:"order_id"`
+		ChargeID string `json:"charge_id"`
+		Amount   int64  `json:"amount"` // Minor units of Currency, as Stripe expects.
+		Currency string `json:"currency"`
+		Reason   string `json:"reason"`
+	}
+
+	RefundOutcomeEvent struct {
+		RefundID       string `json:"refund_id"`
+		OrderID        int64  `json:"order_id"`
+		StripeRefundID string `json:"stripe_refund_id,omitempty"`
+		FailureReason  string `json:"failure_reason,omitempty"`
+	}
+
+	// Refund is the ledger entry of a refund the order service requested.
+	// There is at most one per refund ID.
+	Refund struct {
+		RefundID       string
+		OrderID        int64
+		ChargeID       string
+		StripeRefundID *string
+		Amount         int64 // Minor units of Currency.
+		Currency       string
+		Status         RefundStatus
+		FailureReason  *string
+		CreatedAt      int64
+		UpdatedAt      int64
+	}
+)
+
+// handleRefundRequested asks Stripe to refund the charge, records the refund
+// and reports the outcome on PAYMENTS. Stripe rejecting the refund is an
+// outcome; anything else is returned so the message is redelivered. As for
+// charges, the refund and the inbox record of the event commit together, so
+// a redelivered event has its recorded outcome reported again, and a crash
+// between the refund and the commit is covered by the refund's idempotency
+// key.
+func handleRefundRequested(ctx context.Context, db *sql.DB, js jetstream.JetStream, refunds *refund.Client, event CloudEvent) error {
+	var requested RefundRequestedEvent
+	if err := json.Unmarshal(event.Data, &requested); err != nil {
+		return fmt.Errorf("failed to unmarshal refund event %s: %w", event.ID, err)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	first, err := recordInboxMessage(ctx, tx, event)
+	if err != nil {
+		return err
+	}
+	if !first {
+		// The outcome may not have been published before the crash that
+		// caused the redelivery.
+		recorded, err := scanRefund(tx.QueryRowContext(ctx, getRefundQuery, requested.RefundID))
+		if err != nil {
+			return fmt.Errorf("failed to get refund %s: %w", requested.RefundID, err)
+		}
+		assert.Sometimes(true, "Sometimes a refund request is redelivered after it was refunded", map[string]any{"refund_id": requested.RefundID})
+		log.Printf("Refund %s was already made, reporting its outcome again", requested.RefundID)
+		return publishRefundOutcome(ctx, js, recorded)
+	}
+
+	refunded, err := refundCharge(ctx, refunds, requested)
+	if err != nil {
+		return err
+	}
+
+	recorded, err := scanRefund(tx.QueryRowContext(
+		ctx,
+		insertRefundQuery,
+		refunded.RefundID,
+		refunded.OrderID,
+		refunded.ChargeID,
+		refunded.StripeRefundID,
+		refunded.Amount,
+		refunded.Currency,
+		refunded.Status,
+		refunded.FailureReason,
+		time.Now().Unix(),
+	))
+	if err != nil {
+		return fmt.Errorf("failed to record refund %s: %w", requested.RefundID, err)
+	}
+	assert.AlwaysOrUnreachable(recorded.Status == refunded.Status, "Recorded refunds must have the refund's status", map[string]any{"refund_id": requested.RefundID, "status": recorded.Status})
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return publishRefundOutcome(ctx, js, recorded)
+}
+
+// refundCharge asks Stripe, through refunds, for the refund the order service
+// requested. It returns the refund to record, which is failed when Stripe
+// rejected it. The refund ID doubles as the Stripe idempotency key, so
+// requesting the same refund again never refunds twice.
+func refundCharge(ctx context.Context, refunds *refund.Client, requested RefundRequestedEvent) (Refund, error) {
+	assert.Always(requested.Amount > 0, "Refund amounts must be positive", map[string]any{"refund_id": requested.RefundID, "amount": requested.Amount})
+
+	params := &stripe.RefundParams{
+		Charge: stripe.String(requested.ChargeID),
+		Amount: stripe.Int64(requested.Amount),
+	}
+	params.Context = ctx
+	params.SetIdempotencyKey(requested.RefundID)
+	params.AddMetadata("refund_id", requested.RefundID)
+	params.AddMetadata("order_id", strconv.FormatInt(requested.OrderID, 10))
+	params.AddMetadata("reason", requested.Reason)
+
+	refunded := Refund{
+		RefundID: requested.RefundID,
+		OrderID:  requested.OrderID,
+		ChargeID: requested.ChargeID,
+		Amount:   requested.Amount,
+		Currency: requested.Currency,
+		Status:   RefundStatusSucceeded,
+	}
+
+	re, err := refunds.New(params)
+	if err != nil {
+		var stripeErr *stripe.Error
+		if !errors.As(err, &stripeErr) || stripeErr.HTTPStatusCode < 400 || stripeErr.HTTPStatusCode >= 500 {
+			return refunded, fmt.Errorf("failed to refund charge %s: %w", requested.ChargeID, err)
+		}
+		log.Printf("Stripe rejected refund %s: %v", requested.RefundID, stripeErr.Msg)
+		refunded.Status = RefundStatusFailed
+		refunded.FailureReason = &stripeErr.Msg
+		return refunded, nil
+	}
+
+	refunded.StripeRefundID = &re.ID
+	return refunded, nil
+}
+
+// publishRefundOutcome reports a recorded refund. The outcome reuses the
+// refund ID, so it is the same for every delivery of the request.
+func publishRefundOutcome(ctx context.Context, js jetstream.JetStream, recorded Refund) error {
+	outcome := RefundOutcomeEvent{RefundID: recorded.RefundID, OrderID: recorded.OrderID}
+	eventType := EventTypeRefundSucceeded
+	if recorded.StripeRefundID != nil {
+		outcome.StripeRefundID = *recorded.StripeRefundID
+	}
+	if recorded.Status == RefundStatusFailed {
+		eventType = EventTypeRefundFailed
+		if recorded.FailureReason != nil {
+			outcome.FailureReason = *recorded.FailureReason
+		}
+	}
+
+	outcomeData, err := json.Marshal(outcome)
+	if err != nil {
+		return fmt.Errorf("failed to marshal refund outcome: %w", err)
+	}
+	return publishCloudEvent(ctx, js, refundsSubject, newPaymentCloudEvent(recorded.RefundID, eventType, recorded.OrderID, outcomeData))
+}
+
+func scanRefund(row rowScanner) (Refund, error) {
+	var recorded Refund
+	err := row.Scan(
+		&recorded.RefundID,
+		&recorded.OrderID,
+		&recorded.ChargeID,
+		&recorded.StripeRefundID,
+		&recorded.Amount,
+		&recorded.Currency,
+		&recorded.Status,
+		&recorded.FailureReason,
+		&recorded.CreatedAt,
+		&recorded.UpdatedAt,
+	)
+	return recorded, err
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestRefundChargeRedeliveredRequestRefundsOnce(t *testing.T) {
+	fake, _, refunds := newFakeStripe(t)
+
+	requested := RefundRequestedEvent{
+		RefundID: "9c1e4a7d-3b2f-4e8a-b6d5-1f0a2c3e4d5b",
+		OrderID:  1,
+		ChargeID: "ch_1",
+		Amount:   500,
+		Currency: "usd",
+		Reason:   "requested_by_customer",
+	}
+
+	// The second request stands for a redelivery after a crash between the
+	// refund and the commit of the refund.
+	first, err := refundCharge(context.Background(), refunds, requested)
+	if err != nil {
+		t.Fatalf("first delivery: %v", err)
+	}
+	second, err := refundCharge(context.Background(), refunds, requested)
+	if err != nil {
+		t.Fatalf("second delivery: %v", err)
+	}
+
+	if fake.refunds != 1 {
+		t.Errorf("got %d refunds, want 1", fake.refunds)
+	}
+	if first.StripeRefundID == nil || second.StripeRefundID == nil || *first.StripeRefundID != *second.StripeRefundID {
+		t.Errorf("deliveries got different refunds: %v and %v", first.StripeRefundID, second.StripeRefundID)
+	}
+	if first.Status != RefundStatusSucceeded || second.Status != RefundStatusSucceeded {
+		t.Errorf("got statuses %s and %s, want %s", first.Status, second.Status, RefundStatusSucceeded)
+	}
+}
+
+func TestRefundChargeRejectedIsFailed(t *testing.T) {
+	fake, _, refunds := newFakeStripe(t)
+
+	requested := RefundRequestedEvent{
+		RefundID: "2a7b9c0d-4e5f-4a1b-8c2d-3e4f5a6b7c8d",
+		OrderID:  1,
+		ChargeID: declinedCharge,
+		Amount:   500,
+		Currency: "usd",
+		Reason:   "requested_by_customer",
+	}
+	refunded, err := refundCharge(context.Background(), refunds, requested)
+	if err != nil {
+		t.Fatalf("refund: %v", err)
+	}
+
+	if fake.refunds != 0 {
+		t.Errorf("got %d refunds, want 0", fake.refunds)
+	}
+	if refunded.Status != RefundStatusFailed || refunded.FailureReason == nil || refunded.StripeRefundID != nil {
+		t.Errorf("got %+v, want a failed refund with a failure reason", refunded)
+	}
+}
+
+// TestHandleMessageRedeliveredRefundRequestedRefundsOnce delivers the same
+// ORDER_REFUND_REQUESTED event twice, the first delivery being acked or nak'd
+// after a failure, and checks the charge is refunded and reported once.
+func TestHandleMessageRedeliveredRefundRequestedRefundsOnce(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		failCommits   int
+		failPublishes int
+		wantFirst     string
+	}{
+		{name: "after ack", wantFirst: "ack"},
+		{name: "after failed commit", failCommits: 1, wantFirst: "nak"},
+		{name: "after failed publish", failPublishes: 1, wantFirst: "nak"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake, charges, refunds := newFakeStripe(t)
+			db, sqlDB := newFakeDB(t)
+			db.failCommits = tc.failCommits
+			js := newFakeJetStream()
+			js.failPublishes = tc.failPublishes
+
+			refundID := "9c1e4a7d-3b2f-4e8a-b6d5-1f0a2c3e4d5b"
+			msg := newOrderServiceMessage(t, "0b6f9e4a-2f1d-4c5b-8e7a-3d2c1b0a9f8e", EventTypeOrderRefundRequested, 1, RefundRequestedEvent{
+				RefundID: refundID,
+				OrderID:  1,
+				ChargeID: "ch_1",
+				Amount:   500,
+				Currency: "usd",
+				Reason:   "requested_by_customer",
+			})
+
+			first, second := &fakeMsg{data: msg}, &fakeMsg{data: msg}
+			handleMessage(sqlDB, js, charges, refunds, first)
+			handleMessage(sqlDB, js, charges, refunds, second)
+
+			if first.settled != tc.wantFirst || second.settled != "ack" {
+				t.Errorf("deliveries were settled with %q and %q, want %q and %q", first.settled, second.settled, tc.wantFirst, "ack")
+			}
+			if fake.refunds != 1 {
+				t.Errorf("got %d refunds, want 1", fake.refunds)
+			}
+			if n := db.rows("refunds"); n != 1 {
+				t.Errorf("got %d recorded refunds, want 1", n)
+			}
+			published := js.published()
+			if len(published) != 1 {
+				t.Fatalf("got %d outcome events, want 1", len(published))
+			}
+			if published[0].ID != refundID || published[0].Type != EventTypeRefundSucceeded {
+				t.Errorf("got outcome %s %s, want %s %s", published[0].Type, published[0].ID, EventTypeRefundSucceeded, refundID)
+			}
+			var outcome RefundOutcomeEvent
+			if err := json.Unmarshal(published[0].Data, &outcome); err != nil {
+				t.Fatal(err)
+			}
+			if outcome.RefundID != refundID || outcome.StripeRefundID != "re_1" {
+				t.Errorf("got outcome %+v, want refund %s refunded with re_1", outcome, refundID)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// orderEventSchemas is where the order service keeps the JSON Schemas of its
+// outbox event payloads.
+const orderEventSchemas = "../orderService/eventschema/schemas"
+
+type jsonSchema struct {
+	Required   []string `json:"required"`
+	Properties map[string]struct {
+		Type string `json:"type"`
+	} `json:"properties"`
+}
+
+// TestEventsFollowOrderEventSchemas checks that every field this service
+// reads from an order event is required by the event's schema, with a
+// matching JSON type, so a schema change the structs miss fails here.
+func TestEventsFollowOrderEventSchemas(t *testing.T) {
+	for _, tc := range []struct {
+		schema string
+		event  any
+	}{
+		{"ORDER_CREATED.v2.json", PaymentEvent{}},
+		{"ORDER_REFUND_REQUESTED.v1.json", RefundRequestedEvent{}},
+	} {
+		t.Run(tc.schema, func(t *testing.T) {
+			raw, err := os.ReadFile(filepath.Join(orderEventSchemas, tc.schema))
+			if err != nil {
+				t.Fatalf("failed to read schema: %v", err)
+			}
+			var schema jsonSchema
+			if err := json.Unmarshal(raw, &schema); err != nil {
+				t.Fatalf("failed to parse schema: %v", err)
+			}
+
+			eventType := reflect.TypeOf(tc.event)
+			for i := 0; i < eventType.NumField(); i++ {
+				field := eventType.Field(i)
+				name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+				if !slices.Contains(schema.Required, name) {
+					t.Errorf("%s.%s: %q is not a required property of the schema", eventType.Name(), field.Name, name)
+					continue
+				}
+				if want, got := schema.Properties[name].Type, jsonType(field.Type); want != got {
+					t.Errorf("%s.%s: schema type of %q is %s, field decodes %s", eventType.Name(), field.Name, name, want, got)
+				}
+			}
+		})
+	}
+}
+
+func jsonType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return "integer"
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Slice:
+		return "array"
+	case reflect.Struct, reflect.Map:
+		return "object"
+	default:
+		return t.Kind().String()
+	}
+}
@@ -17,14 +17,14 @@ import (
 )
 
 type Order struct {
-	ID          int64   `json:"id" db:"id"`
-	Amount      float64 `json:"amount" db:"amount"`
-	Currency    string  `json:"currency" db:"currency"`
-	Customer    string  `json:"customer" db:"customer"`
-	Description string  `json:"description" db:"description"`
-	CreatedAt   int64   `json:"created_at" db:"created_at"`
-	UpdatedAt   *int64  `json:"updated_at,omitempty" db:"updated_at"`
-	Status      string  `json:"status" db:"status"`
+	ID          int64  `json:"id" db:"id"`
+	Amount      int64  `json:"amount" db:"amount"` // Minor units.
+	Currency    string `json:"currency" db:"currency"`
+	Customer    string `json:"customer" db:"customer"`
+	Description string `json:"description" db:"description"`
+	CreatedAt   int64  `json:"created_at" db:"created_at"`
+	UpdatedAt   *int64 `json:"updated_at,omitempty" db:"updated_at"`
+	Status      string `json:"status" db:"status"`
 }
 
 type OrderClient struct {
@@ -313,7 +313,7 @@ func genOrder() *Order {
 	}
 
 	return &Order{
-		Amount:      float64(random.GetRandom() % 1000000), // Added a reasonable limit for amount
+		Amount:      int64(random.GetRandom() % 1000000), // Added a reasonable limit for amount
 		Currency:    "usd",
 		Customer:    randomString((SafeUint64ToIntCapped(random.GetRandom()%100) + 1)),
 		Description: randomString((SafeUint64ToIntCapped(random.GetRandom()%100) + 1)),
@@ -7,6 +7,7 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -18,14 +19,14 @@ import (
 )
 
 type Order struct {
-	ID          int64   `json:"id" db:"id"`
-	Amount      float64 `json:"amount" db:"amount"`
-	Currency    string  `json:"currency" db:"currency"`
-	Customer    string  `json:"customer" db:"customer"`
-	Description string  `json:"description" db:"description"`
-	CreatedAt   int64   `json:"created_at" db:"created_at"`
-	UpdatedAt   *int64  `json:"updated_at,omitempty" db:"updated_at"`
-	Status      string  `json:"status" db:"status"`
+	ID          int64  `json:"id" db:"id"`
+	Amount      int64  `json:"amount" db:"amount"` // Minor units.
+	Currency    string `json:"currency" db:"currency"`
+	Customer    string `json:"customer" db:"customer"`
+	Description string `json:"description" db:"description"`
+	CreatedAt   int64  `json:"created_at" db:"created_at"`
+	UpdatedAt   *int64 `json:"updated_at,omitempty" db:"updated_at"`
+	Status      string `json:"status" db:"status"`
 }
 
 type OrderClient struct {
@@ -34,11 +35,20 @@ type OrderClient struct {
 	http *http.Client
 }
 
+type OrderListPage struct {
+	Orders     []Order `json:"orders"`
+	NextCursor string  `json:"next_cursor,omitempty"`
+}
+
 type OrderListResult struct {
 	out        []Order
 	statusCode int
 }
 
+// settleTimeout bounds how long the command waits for pending orders to be
+// settled by the payment service.
+const settleTimeout = 2 * time.Minute
+
 type FinallyQuiescentCommand struct {
 	client *OrderClient
 }
@@ -87,12 +97,13 @@ func main() {
 	if err != nil {
 		log.Fatalf("error: %v\n", err)
 	}
-	actualCount, err := cmd.client.List()
+	// Orders settle asynchronously through the outbox and the payment
+	// service, so give the pipeline time to drain before asserting.
+	actualCount, err := cmd.client.ListSettled(settleTimeout)
 	if err != nil {
 		log.Fatalf("error: %v\n", err)
 	}
 
-	// BUG: The completion path is not implemented.
 	assert.Always(Validate(globalCount, actualCount) == nil, "Order processing is eventually consistent", map[string]any{"global_count": globalCount, "actual_count": len(actualCount.out)})
 	log.Printf("Completed finally test command\n")
 }
@@ -110,43 +121,92 @@ func sumCount(dir string) (int, error) {
 		}
 		count, err := strconv.Atoi(strings.TrimSpace(string(content)))
 		if err != nil {
-			return 0, fmt.Errorf("error converting content to integer in file &s: %v\n", file.Name(), err)
+			return 0, fmt.Errorf("error converting content to integer in file %s: %v\n", file.Name(), err)
 		}
 		sum += count
 	}
 	return sum, nil
 }
 
+// ListSettled lists the orders until none is pending or timeout elapses, and
+// returns the last listing.
+func (c *OrderClient) ListSettled(timeout time.Duration) (*OrderListResult, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		result, err := c.List()
+		if err != nil {
+			return nil, err
+		}
+		pending := 0
+		for _, order := range result.out {
+			if order.Status == "pending" {
+				pending++
+			}
+		}
+		if pending == 0 || time.Now().After(deadline) {
+			return result, nil
+		}
+		log.Printf("Waiting for %d pending orders to settle...\n", pending)
+		time.Sleep(time.Second)
+	}
+}
+
 func (c *OrderClient) List() (*OrderListResult, error) {
-	url := fmt.Sprintf("http://%v:%d/orders", c.host, c.port)
+	var (
+		orders []Order
+		cursor string
+	)
+	for {
+		page, statusCode, err := c.listPage(cursor)
+		if err != nil {
+			return nil, err
+		}
+		if statusCode != http.StatusOK {
+			return &OrderListResult{
+				out:        nil,
+				statusCode: statusCode,
+			}, nil
+		}
+		orders = append(orders, page.Orders...)
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+
+	return &OrderListResult{
+		out:        orders,
+		statusCode: http.StatusOK,
+	}, nil
+}
+
+func (c *OrderClient) listPage(cursor string) (*OrderListPage, int, error) {
+	query := url.Values{"limit": {"1000"}}
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
+	url := fmt.Sprintf("http://%v:%d/orders?%s", c.host, c.port, query.Encode())
 	resp, err := http.Get(url)
 	if err != nil {
-		return nil, fmt.Errorf("error reading orders: %v\n", err)
+		return nil, 0, fmt.Errorf("error reading orders: %v\n", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return &OrderListResult{
-			out:        nil,
-			statusCode: resp.StatusCode,
-		}, nil
+		return nil, resp.StatusCode, nil
 	}
 
 	assert.AlwaysOrUnreachable(resp.StatusCode == http.StatusOK, "", nil)
 
-	var orders []Order
+	var page OrderListPage
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("error reading response body: %v", err)
+		return nil, 0, fmt.Errorf("error reading response body: %v", err)
 	}
-	if err := json.Unmarshal(body, &orders); err != nil {
-		return nil, fmt.Errorf("error unmarshaling response: %v", err)
+	if err := json.Unmarshal(body, &page); err != nil {
+		return nil, 0, fmt.Errorf("error unmarshaling response: %v", err)
 	}
-
-	return &OrderListResult{
-		out:        orders,
-		statusCode: resp.StatusCode,
-	}, nil
+	return &page, resp.StatusCode, nil
 }
 
 func Validate(globalCount int, source *OrderListResult) error {
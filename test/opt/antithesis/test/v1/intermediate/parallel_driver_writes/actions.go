@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/antithesishq/antithesis-sdk-go/assert"
+	"github.com/antithesishq/antithesis-sdk-go/random"
+)
+
+// followUp is an action on an order the driver just created. Actions only
+// return errors the order service could not have caused; its own failures
+// are checked with assertions, and transport errors and 5xx responses are
+// expected while faults are injected.
+type followUp func(cmd *ParallelDriverCommand, order *Order) error
+
+var followUps = []followUp{
+	nil, // Leave the order alone.
+	(*ParallelDriverCommand).cancel,
+	(*ParallelDriverCommand).updateConcurrently,
+	(*ParallelDriverCommand).writeFractional,
+	(*ParallelDriverCommand).watch,
+	(*ParallelDriverCommand).refund,
+}
+
+func (cmd *ParallelDriverCommand) followUp(order *Order) error {
+	action := random.RandomChoice(followUps)
+	if action == nil {
+		return nil
+	}
+	return action(cmd, order)
+}
+
+// cancel cancels the order, sometimes after its payment had time to settle,
+// in which case the order service must refuse.
+func (cmd *ParallelDriverCommand) cancel(order *Order) error {
+	time.Sleep(time.Duration(random.GetRandom()%2000) * time.Millisecond)
+
+	resp, body, err := cmd.client.do(http.MethodPost, fmt.Sprintf("/orders/%d/cancel", order.ID), nil, nil)
+	if err != nil || resp.StatusCode >= 500 {
+		log.Printf("Failed to cancel order %d: %v %s\n", order.ID, err, body)
+		return nil
+	}
+
+	assert.Always(resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusConflict, "Cancelling an order either succeeds or conflicts with its status", map[string]any{"order_id": order.ID, "status_code": resp.StatusCode})
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	var cancelled Order
+	if err := json.Unmarshal(body, &cancelled); err != nil {
+		return fmt.Errorf("error unmarshaling cancelled order: %v", err)
+	}
+	assert.Always(cancelled.Status == "cancelled", "Cancelled orders are reported as cancelled", map[string]any{"order_id": order.ID, "status": cancelled.Status})
+	return nil
+}
+
+// updateConcurrently sends concurrent updates of the order against the same
+// version, so at most one of them may apply.
+func (cmd *ParallelDriverCommand) updateConcurrently(order *Order) error {
+	resp, body, err := cmd.client.do(http.MethodGet, fmt.Sprintf("/orders/%d", order.ID), nil, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Printf("Failed to get order %d: %v %s\n", order.ID, err, body)
+		return nil
+	}
+	etag := resp.Header.Get("ETag")
+	assert.Always(etag != "", "Orders are served with an ETag", map[string]any{"order_id": order.ID})
+
+	const updates = 2
+	var (
+		wg    sync.WaitGroup
+		codes [updates]int
+	)
+	for i := range updates {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			update := map[string]any{"description": fmt.Sprintf("update %d of order %d", i, order.ID)}
+			resp, body, err := cmd.client.do(http.MethodPatch, fmt.Sprintf("/orders/%d", order.ID), update, http.Header{"If-Match": {etag}})
+			if err != nil {
+				log.Printf("Failed to update order %d: %v\n", order.ID, err)
+				return
+			}
+			if resp.StatusCode >= 500 {
+				log.Printf("Failed to update order %d: %s\n", order.ID, body)
+			}
+			codes[i] = resp.StatusCode
+		}()
+	}
+	wg.Wait()
+
+	applied := 0
+	for _, code := range codes {
+		if code == 0 || code >= 500 {
+			continue
+		}
+		assert.Always(code == http.StatusOK || code == http.StatusPreconditionFailed, "Updates either apply or fail their precondition", map[string]any{"order_id": order.ID, "status_code": code})
+		if code == http.StatusOK {
+			applied++
+		}
+	}
+	assert.Always(applied <= 1, "At most one update against the same version applies", map[string]any{"order_id": order.ID, "codes": codes})
+	return nil
+}
+
+// writeFractional submits the order again with half a minor unit added to
+// its amount, which the order service must reject instead of rounding.
+func (cmd *ParallelDriverCommand) writeFractional(order *Order) error {
+	payload := map[string]any{
+		"amount":      json.Number(fmt.Sprintf("%d.5", order.Amount)),
+		"currency":    order.Currency,
+		"customer":    order.Customer,
+		"description": order.Description,
+	}
+	resp, body, err := cmd.client.do(http.MethodPost, "/orders", payload, nil)
+	if err != nil || resp.StatusCode >= 500 {
+		log.Printf("Failed to write fractional order: %v %s\n", err, body)
+		return nil
+	}
+	assert.Always(resp.StatusCode == http.StatusBadRequest, "Orders with sub-minor-unit amounts are rejected", map[string]any{"amount": payload["amount"], "status_code": resp.StatusCode})
+	return nil
+}
+
+// watch long-polls the order until it is no longer pending, which it should
+// be once the payment service settled it.
+func (cmd *ParallelDriverCommand) watch(order *Order) error {
+	watched, err := cmd.watchSettled(order)
+	if err != nil || watched == nil {
+		return err
+	}
+	if watched.Status == "pending" {
+		log.Printf("Order %d is still pending after watching it\n", order.ID)
+	}
+	return nil
+}
+
+// refund waits for the order to be charged and refunds all or part of it,
+// sometimes followed by a refund of what is left.
+func (cmd *ParallelDriverCommand) refund(order *Order) error {
+	watched, err := cmd.watchSettled(order)
+	if err != nil || watched == nil || watched.Status != "succeeded" {
+		return err
+	}
+
+	refundable := watched.Amount
+	for refundable > 0 {
+		// An omitted amount refunds everything that is left.
+		request := map[string]any{"reason": "requested_by_customer"}
+		amount := refundable
+		if refundable > 1 && random.GetRandom()%2 == 0 {
+			amount = int64(random.GetRandom()%uint64(refundable-1)) + 1
+			request["amount"] = amount
+		}
+
+		resp, body, err := cmd.client.do(http.MethodPost, fmt.Sprintf("/orders/%d/refunds", order.ID), request, nil)
+		if err != nil || resp.StatusCode >= 500 {
+			log.Printf("Failed to refund order %d: %v %s\n", order.ID, err, body)
+			return nil
+		}
+		assert.Always(resp.StatusCode == http.StatusAccepted, "Refunds of charged orders within the refundable amount are accepted", map[string]any{"order_id": order.ID, "amount": amount, "refundable": refundable, "status_code": resp.StatusCode})
+		if resp.StatusCode != http.StatusAccepted {
+			return nil
+		}
+
+		refundable -= amount
+		if random.GetRandom()%2 == 0 {
+			return nil
+		}
+	}
+	return nil
+}
+
+// watchSettled long-polls the order while it is pending. It returns nil when
+// the order service failed to answer.
+func (cmd *ParallelDriverCommand) watchSettled(order *Order) (*Order, error) {
+	resp, body, err := cmd.client.do(http.MethodGet, fmt.Sprintf("/orders/%d/watch?since_status=pending&timeout=30s", order.ID), nil, nil)
+	if err != nil || resp.StatusCode >= 500 {
+		log.Printf("Failed to watch order %d: %v %s\n", order.ID, err, body)
+		return nil, nil
+	}
+	assert.Always(resp.StatusCode == http.StatusOK, "Watching an order succeeds", map[string]any{"order_id": order.ID, "status_code": resp.StatusCode})
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil
+	}
+
+	var watched Order
+	if err := json.Unmarshal(body, &watched); err != nil {
+		return nil, fmt.Errorf("error unmarshaling watched order: %v", err)
+	}
+	assert.Always(watched.ID == order.ID, "Watching an order returns that order", map[string]any{"order_id": order.ID, "watched_id": watched.ID})
+	return &watched, nil
+}
+
+// The order service's amount limits for usd, the currency genOrder uses, in
+// minor units.
+const (
+	minOrderAmount = 50
+	maxOrderAmount = 99999999
+)
+
+// validAmount reports whether the order service accepts amount for a usd
+// order.
+func validAmount(amount int64) bool {
+	return amount >= minOrderAmount && amount <= maxOrderAmount
+}
+
+// batchResult is one result of POST /orders:batch.
+type batchResult struct {
+	Index  int    `json:"index"`
+	Status int    `json:"status"`
+	Order  *Order `json:"order,omitempty"`
+}
+
+// writeBatch creates a batch of orders, some of them invalid, in a random
+// mode, and returns how many orders were created. Batches are not retried, so
+// orders of a batch whose response was lost are not counted.
+func (cmd *ParallelDriverCommand) writeBatch() (int, error) {
+	mode := random.RandomChoice([]string{"atomic", "best_effort"})
+	size := int(random.GetRandom()%10) + 1
+
+	orders := make([]any, size)
+	invalid := make([]bool, size)
+	for i := range orders {
+		order := genOrder()
+		if random.GetRandom()%4 == 0 {
+			// Customers must not be empty.
+			order.Customer = ""
+		}
+		invalid[i] = order.Customer == "" || !validAmount(order.Amount)
+		orders[i] = order
+	}
+
+	resp, body, err := cmd.client.do(http.MethodPost, "/orders:batch", map[string]any{"mode": mode, "orders": orders}, nil)
+	if err != nil || resp.StatusCode >= 500 {
+		log.Printf("Failed to write batch: %v %s\n", err, body)
+		return 0, nil
+	}
+	assert.Always(
+		resp.StatusCode == http.StatusAccepted || resp.StatusCode == http.StatusMultiStatus || resp.StatusCode == http.StatusUnprocessableEntity,
+		"Batches are accepted, partially accepted or rejected",
+		map[string]any{"mode": mode, "status_code": resp.StatusCode},
+	)
+
+	var response struct {
+		Results []batchResult `json:"results"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return 0, fmt.Errorf("error unmarshaling batch response: %v", err)
+	}
+	assert.Always(len(response.Results) == size, "Batches report a result per order", map[string]any{"size": size, "results": len(response.Results)})
+
+	anyInvalid := false
+	for _, v := range invalid {
+		anyInvalid = anyInvalid || v
+	}
+	created := 0
+	for _, result := range response.Results {
+		if result.Index < 0 || result.Index >= size {
+			return 0, fmt.Errorf("batch result index %d out of range", result.Index)
+		}
+		if result.Status == http.StatusAccepted {
+			created++
+			assert.Always(result.Order != nil, "Created batch orders are returned", map[string]any{"index": result.Index})
+		}
+		assert.Always(!invalid[result.Index] || result.Status == http.StatusBadRequest, "Invalid batch orders are rejected", map[string]any{"index": result.Index, "status": result.Status})
+		assert.Always(invalid[result.Index] || result.Status == http.StatusAccepted || (mode == "atomic" && anyInvalid), "Valid batch orders are created unless an atomic batch is rejected", map[string]any{"mode": mode, "index": result.Index, "status": result.Status})
+	}
+	assert.Always(mode != "atomic" || !anyInvalid || created == 0, "Atomic batches with an invalid order create nothing", map[string]any{"created": created})
+	return created, nil
+}
+
+// do sends a request to the order service and returns the response with its
+// body read.
+func (c *OrderClient) do(method, path string, payload any, header http.Header) (*http.Response, []byte, error) {
+	var reqBody io.Reader
+	if payload != nil {
+		bs, err := json.Marshal(payload)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error marshaling request: %v", err)
+		}
+		reqBody = bytes.NewReader(bs)
+	}
+
+	url := fmt.Sprintf("http://%v:%d%s", c.host, c.port, path)
+	req, err := http.NewRequest(method, url, reqBody)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating request: %v", err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error making request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading response body: %v", err)
+	}
+	return resp, body, nil
+}
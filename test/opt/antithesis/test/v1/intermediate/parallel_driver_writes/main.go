@@ -21,14 +21,14 @@ import (
 )
 
 type Order struct {
-	ID          int64   `json:"id" db:"id"`
-	Amount      float64 `json:"amount" db:"amount"`
-	Currency    string  `json:"currency" db:"currency"`
-	Customer    string  `json:"customer" db:"customer"`
-	Description string  `json:"description" db:"description"`
-	CreatedAt   int64   `json:"created_at" db:"created_at"`
-	UpdatedAt   *int64  `json:"updated_at,omitempty" db:"updated_at"`
-	Status      string  `json:"status" db:"status"`
+	ID          int64  `json:"id" db:"id"`
+	Amount      int64  `json:"amount" db:"amount"` // Minor units.
+	Currency    string `json:"currency" db:"currency"`
+	Customer    string `json:"customer" db:"customer"`
+	Description string `json:"description" db:"description"`
+	CreatedAt   int64  `json:"created_at" db:"created_at"`
+	UpdatedAt   *int64 `json:"updated_at,omitempty" db:"updated_at"`
+	Status      string `json:"status" db:"status"`
 }
 
 type OrderClient struct {
@@ -43,6 +43,10 @@ type OrderWriteResult struct {
 	statusCode int
 }
 
+// maxWriteAttempts bounds how often a write is retried after a transport
+// error or a 500 before the driver gives up on it.
+const maxWriteAttempts = 3
+
 type counter struct {
 	count int
 	file  string
@@ -113,6 +117,19 @@ func main() {
 }
 
 func (cmd *ParallelDriverCommand) process() error {
+	if random.GetRandom()%10 == 0 {
+		created, err := cmd.writeBatch()
+		if err != nil {
+			return err
+		}
+		if created > 0 {
+			cmd.counter.count += created
+			if err := cmd.counter.save(); err != nil {
+				return err
+			}
+		}
+	}
+
 	result, err := cmd.client.Write()
 	if err != nil {
 		return err
@@ -125,13 +142,17 @@ func (cmd *ParallelDriverCommand) process() error {
 	// Write was succesful and should count it.
 	// 1) 200.
 	// 2) 300-400 - No.
-	// 3) 500 - Maybe.
+	// 3) 500 - Retried with the same idempotency key until it is accepted.
 	cmd.counter.count++
 	err = cmd.counter.save()
 	if err != nil {
 		return err
 	}
 
+	if err := cmd.followUp(result.out); err != nil {
+		return err
+	}
+
 	time.Sleep(1 * time.Second)
 
 	return nil
@@ -165,14 +186,40 @@ func (c *counter) load() error {
 
 func (c *OrderClient) Write() (*OrderWriteResult, error) {
 	payload := genOrder()
+	idempotencyKey := uuid.New().String()
+
+	var (
+		result *OrderWriteResult
+		err    error
+	)
+	for attempt := 0; attempt < maxWriteAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+		}
+		result, err = c.write(payload, idempotencyKey)
+		if err == nil && result.statusCode != http.StatusInternalServerError {
+			assert.Sometimes(attempt > 0 && result.statusCode == http.StatusAccepted, "Sometimes a write is accepted after a retry with the same idempotency key", map[string]any{"attempt": attempt})
+			break
+		}
+	}
+	return result, err
+}
 
+func (c *OrderClient) write(payload *Order, idempotencyKey string) (*OrderWriteResult, error) {
 	bs, err := json.Marshal(payload)
 	if err != nil {
 		return nil, fmt.Errorf("error marshaling order: %v\n", err)
 	}
 
 	url := fmt.Sprintf("http://%v:%d/orders", c.host, c.port)
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(bs))
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(bs))
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v\n", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", idempotencyKey)
+
+	resp, err := c.http.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("error making request: %v\n", err)
 	}
@@ -213,7 +260,7 @@ func genOrder() *Order {
 	}
 
 	return &Order{
-		Amount:      float64(random.GetRandom() % 1000000), // Added a reasonable limit for amount
+		Amount:      int64(random.GetRandom() % 1000000), // Added a reasonable limit for amount
 		Currency:    "usd",
 		Customer:    randomString((SafeUint64ToIntCapped(random.GetRandom()%100) + 1)),
 		Description: randomString((SafeUint64ToIntCapped(random.GetRandom()%100) + 1)),